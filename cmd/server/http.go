@@ -1,17 +1,26 @@
 package main
 
 import (
+	"crypto/subtle"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/service"
 	"github.com/abdulhaseeb08/protocol/logger"
 )
 
 type httpHandler struct {
-	svc *service.Service
+	svc          *service.Service
+	controlToken string
 }
 
-func (h *httpHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		h.control(w, r)
+		return
+	}
+
 	info, err := h.svc.Status()
 	if err != nil {
 		logger.Errorw("failed to read status", err)
@@ -20,3 +29,44 @@ func (h *httpHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write(info)
 }
+
+// control handles POST /stop?egress_id=, /kill?egress_id= and /log_level?level=
+func (h *httpHandler) control(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	switch r.URL.Path {
+	case "/stop":
+		if !h.svc.StopEgress(query.Get("egress_id")) {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case "/kill":
+		if !h.svc.KillEgress(query.Get("egress_id")) {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case "/log_level":
+		if err := h.svc.SetLogLevel(query.Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// authorized checks the control token if one is configured, and otherwise only allows requests from localhost
+func (h *httpHandler) authorized(r *http.Request) bool {
+	if h.controlToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(token), []byte(h.controlToken)) == 1
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -13,6 +13,7 @@ import (
 	"google.golang.org/protobuf/encoding/protojson"
 
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/encryption"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/service"
 	"github.com/abdulhaseeb08/egress-ehancement/version"
@@ -43,10 +44,29 @@ func main() {
 					&cli.StringFlag{
 						Name: "temp-path",
 					},
+					&cli.StringFlag{
+						Name: "web-env",
+					},
+					&cli.StringFlag{
+						Name: "ipc-socket",
+					},
 				},
 				Action: runHandler,
 				Hidden: true,
 			},
+			{
+				Name:        "decrypt",
+				Usage:       "decrypts a file or segment which was encrypted before upload",
+				ArgsUsage:   "<input> <output>",
+				Description: "unwraps the data key with the client_encryption private key or kms key from the config",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "private-key",
+						Usage: "pem encoded rsa private key file, instead of the config",
+					},
+				},
+				Action: runDecrypt,
+			},
 		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
@@ -84,7 +104,7 @@ func runService(c *cli.Context) error {
 
 	if conf.HealthPort != 0 {
 		go func() {
-			_ = http.ListenAndServe(fmt.Sprintf(":%d", conf.HealthPort), &httpHandler{svc: svc})
+			_ = http.ListenAndServe(fmt.Sprintf(":%d", conf.HealthPort), &httpHandler{svc: svc, controlToken: conf.ControlToken})
 		}()
 	}
 
@@ -136,8 +156,13 @@ func runHandler(c *cli.Context) error {
 		return err
 	}
 
-	req := &livekit.StartEgressRequest{}
 	reqString := c.String("request")
+	if reqString == "" {
+		// pre-spawned by the service, requests arrive on stdin
+		return service.ServePooledRequests(ctx, conf, egress.NewRedisRPCServer(rc), c.String("ipc-socket"))
+	}
+
+	req := &livekit.StartEgressRequest{}
 	err = protojson.Unmarshal([]byte(reqString), req)
 	if err != nil {
 		span.RecordError(err)
@@ -145,7 +170,7 @@ func runHandler(c *cli.Context) error {
 	}
 
 	rpcHandler := egress.NewRedisRPCServer(rc)
-	handler := service.NewHandler(conf, rpcHandler)
+	handler := service.NewHandler(conf, rpcHandler, tmpPath, c.String("web-env"), c.String("ipc-socket"))
 
 	killChan := make(chan os.Signal, 1)
 	signal.Notify(killChan, syscall.SIGINT)
@@ -160,6 +185,46 @@ func runHandler(c *cli.Context) error {
 	return nil
 }
 
+func runDecrypt(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return cli.ShowSubcommandHelp(c)
+	}
+
+	encryptionConf := &config.ClientEncryptionConfig{}
+	if c.String("config") != "" || c.String("config-body") != "" {
+		conf, err := getConfig(c)
+		if err != nil {
+			return err
+		}
+		if conf.ClientEncryption != nil {
+			encryptionConf = conf.ClientEncryption
+		}
+	}
+	if keyFile := c.String("private-key"); keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		encryptionConf = &config.ClientEncryptionConfig{PrivateKey: string(content)}
+	}
+	if encryptionConf.PrivateKey == "" && encryptionConf.KMS == nil {
+		return errors.New("a private key or kms key is required")
+	}
+
+	provider, err := encryption.NewKeyProvider(encryptionConf)
+	if err != nil {
+		return err
+	}
+
+	header, err := encryption.DecryptFile(c.Context, provider, c.Args().Get(0), c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("decrypted %s with key %s\n", c.Args().Get(1), header.KeyID)
+	return nil
+}
+
 func getConfig(c *cli.Context) (*config.Config, error) {
 	configFile := c.String("config")
 	configBody := c.String("config-body")
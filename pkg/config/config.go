@@ -1,8 +1,14 @@
 package config
 
 import (
+	"encoding/base64"
+	"fmt"
+	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-logr/zapr"
@@ -11,6 +17,7 @@ import (
 	"gopkg.in/yaml.v3"
 
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+	"github.com/abdulhaseeb08/protocol/egress"
 	"github.com/abdulhaseeb08/protocol/livekit"
 	"github.com/abdulhaseeb08/protocol/logger"
 	"github.com/abdulhaseeb08/protocol/redis"
@@ -24,6 +31,36 @@ const (
 	trackCompositeCpuCost = 2
 	fileAndStreamCpuCost  = 2 // adding a new line for cpu cost
 	trackCpuCost          = 1
+
+	roomCompositeMemoryCost  = 1
+	webMemoryCost            = 1
+	trackCompositeMemoryCost = 0.5
+	trackMemoryCost          = 0.25
+	memoryMinFreeMB          = 512
+
+	watchdogMaxRecoveries = 3
+
+	diskMinFreeMB         = 1024
+	diskStopFreeMB        = 256
+	diskEstimatedDuration = time.Hour
+
+	warmPoolWidth  = 1920
+	warmPoolHeight = 1080
+	warmPoolDepth  = 24
+
+	handlerPoolMaxUses = 10
+
+	janitorInterval  = time.Minute * 10
+	janitorRetention = time.Hour * 24
+
+	uploadObjectTimeout = time.Minute * 15
+	uploadTotalTimeout  = time.Hour
+
+	clientEncryptionChunkSize = 64 * 1024
+
+	resourceLimitsCgroupPath = "/sys/fs/cgroup/egress"
+
+	tenantWindow = time.Hour * 24
 )
 
 type Config struct {
@@ -33,25 +70,90 @@ type Config struct {
 	WsUrl     string             `yaml:"ws_url"`     // required (env LIVEKIT_WS_URL)
 
 	HealthPort           int    `yaml:"health_port"`
+	ControlToken         string `yaml:"control_token"` // required for control requests from other hosts
 	PrometheusPort       int    `yaml:"prometheus_port"`
 	LogLevel             string `yaml:"log_level"`
 	TemplateBase         string `yaml:"template_base"`
 	Insecure             bool   `yaml:"insecure"`
 	LocalOutputDirectory string `yaml:"local_directory"` // used for temporary storage before upload
 
+	// node labels, which requests can be constrained to. Added to all prometheus metrics
+	Labels map[string]string `yaml:"labels"`
+	// only accept requests with constraints matching the node labels
+	Dedicated bool `yaml:"dedicated"`
+
+	// interval between ACTIVE progress updates. Disabled when 0
+	ProgressUpdateInterval time.Duration `yaml:"progress_update_interval"`
+
+	// number of times a handler which crashed before becoming active will be relaunched
+	HandlerRelaunches int `yaml:"handler_relaunches"`
+
 	S3     *S3Config    `yaml:"s3"`
 	Azure  *AzureConfig `yaml:"azure"`
 	GCP    *GCPConfig   `yaml:"gcp"`
 	AliOSS *S3Config    `yaml:"alioss"`
+	Local  *LocalConfig `yaml:"local"`
+	HTTP   *HTTPConfig  `yaml:"http"`
+	SFTP   *SFTPConfig  `yaml:"sftp"`
+
+	// locations reported for the default storage
+	Location LocationConfig `yaml:"location"`
+
+	// object options for the default storage
+	ObjectOptions ObjectOptionsConfig `yaml:"object_options"`
+
+	// named storage, selected per request
+	Storage map[string]*StorageConfig `yaml:"storage"`
+
+	// storage profiles which file and segment outputs are also uploaded to
+	Replication ReplicationConfig `yaml:"replication"`
 
 	// CPU costs for various egress types
 	CPUCost CPUCostConfig `yaml:"cpu_cost"`
 
+	// memory costs for various egress types, in GB
+	MemoryCost MemoryCostConfig `yaml:"memory_cost"`
+
+	// stalled pipeline detection
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+
+	// local disk space limits
+	Disk DiskConfig `yaml:"disk"`
+
+	// requests waiting for capacity
+	Queue QueueConfig `yaml:"queue"`
+
+	// per-tenant quotas, shared by all nodes through redis
+	Tenants []*TenantConfig `yaml:"tenants"`
+
+	// cleanup of files left behind by failed handlers
+	Janitor JanitorConfig `yaml:"janitor"`
+
+	// upload deadlines, so that a hung upload can't keep a handler from exiting
+	UploadTimeout UploadTimeoutConfig `yaml:"upload_timeout"`
+
+	// files and segments are encrypted on the node before upload. Disabled when nil
+	ClientEncryption *ClientEncryptionConfig `yaml:"client_encryption"`
+
+	// pre-launched chrome instances for web requests
+	WarmPool WarmPoolConfig `yaml:"warm_pool"`
+
+	// pre-spawned handler processes for track and track composite requests
+	HandlerPool HandlerPoolConfig `yaml:"handler_pool"`
+
+	// cpu and memory limits for handler processes
+	ResourceLimits ResourceLimitsConfig `yaml:"resource_limits"`
+
 	SessionLimits `yaml:"session_limits"`
 
 	// internal
-	NodeID     string      `yaml:"-"`
-	FileUpload interface{} `yaml:"-"` // one of S3, Azure, or GCP
+	NodeID     string          `yaml:"-"`
+	FileUpload interface{}     `yaml:"-"` // one of S3, Azure, or GCP
+	logLevel   zap.AtomicLevel `yaml:"-"`
+
+	storageUploads   map[string]interface{}
+	storageLocations map[string]LocationConfig
+	storageOptions   map[string]ObjectOptionsConfig
 }
 
 type S3Config struct {
@@ -74,6 +176,162 @@ type GCPConfig struct {
 	Bucket          string `yaml:"bucket"`
 }
 
+// LocalConfig publishes files into a directory, such as a mounted volume.
+// Files are only renamed into place once complete
+type LocalConfig struct {
+	Root     string `yaml:"root"`
+	FileMode string `yaml:"file_mode"` // octal, ex. "0640"
+	UID      *int   `yaml:"uid"`
+	GID      *int   `yaml:"gid"`
+
+	fileMode os.FileMode
+}
+
+// HTTPConfig uploads each file with a single request to a url template, or to presigned urls
+type HTTPConfig struct {
+	URL     string            `yaml:"url"`    // ex. "https://storage.example.com/recordings/{filepath}"
+	Method  string            `yaml:"method"` // PUT or POST, defaults to PUT
+	Headers map[string]string `yaml:"headers"`
+
+	// presigned urls from the request, by storage filepath or filename
+	URLs map[string]string `yaml:"-"`
+}
+
+// SFTPConfig uploads files over sftp. The host key must be pinned
+type SFTPConfig struct {
+	Host       string `yaml:"host"` // port defaults to 22
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+	PrivateKey string `yaml:"private_key"` // pem encoded
+	HostKey    string `yaml:"host_key"`    // authorized_keys format, ex. "ssh-ed25519 AAAA..."
+	Directory  string `yaml:"directory"`   // remote directory files are uploaded to
+}
+
+// GetFileMode returns the mode for published files, or 0 to keep the default
+func (c *LocalConfig) GetFileMode() os.FileMode {
+	return c.fileMode
+}
+
+// ResolvePath returns the destination of a storage filepath, which must be inside the root
+func (c *LocalConfig) ResolvePath(storageFilepath string) (string, error) {
+	root := path.Clean(c.Root)
+	dest := path.Join(root, storageFilepath)
+	rel, err := filepath.Rel(root, dest)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.ErrInvalidInput("filepath")
+	}
+	return dest, nil
+}
+
+// StorageConfig is a named storage profile. Only one should be set
+type StorageConfig struct {
+	S3     *S3Config    `yaml:"s3"`
+	Azure  *AzureConfig `yaml:"azure"`
+	GCP    *GCPConfig   `yaml:"gcp"`
+	AliOSS *S3Config    `yaml:"alioss"`
+	Local  *LocalConfig `yaml:"local"`
+	HTTP   *HTTPConfig  `yaml:"http"`
+	SFTP   *SFTPConfig  `yaml:"sftp"`
+
+	Location      LocationConfig      `yaml:"location"`
+	ObjectOptions ObjectOptionsConfig `yaml:"object_options"`
+}
+
+// LocationConfig changes the location reported for uploaded files and playlists
+type LocationConfig struct {
+	CDNBaseURL    string        `yaml:"cdn_base_url"`   // replaces the storage url, followed by the storage filepath
+	PresignExpiry time.Duration `yaml:"presign_expiry"` // report a presigned download url instead. s3, gcp, azure and alioss only
+}
+
+type ObjectKind string
+
+const (
+	ObjectKindFile     ObjectKind = "file"
+	ObjectKindSegment  ObjectKind = "segment"
+	ObjectKindPlaylist ObjectKind = "playlist"
+	ObjectKindManifest ObjectKind = "manifest"
+)
+
+// ObjectOptionsConfig sets object options for each kind of uploaded file
+type ObjectOptionsConfig struct {
+	File     ObjectOptions `yaml:"file"`
+	Segment  ObjectOptions `yaml:"segment"`
+	Playlist ObjectOptions `yaml:"playlist"`
+	Manifest ObjectOptions `yaml:"manifest"`
+}
+
+// ObjectOptions are applied to uploaded objects. Options which the storage does not support are ignored
+type ObjectOptions struct {
+	StorageClass string            `yaml:"storage_class"` // s3, gcp and alioss storage class, or azure access tier
+	ACL          string            `yaml:"acl"`           // s3 and alioss canned acl, or gcp predefined acl
+	CacheControl string            `yaml:"cache_control"` // s3, gcp, azure, alioss and http
+	Encryption   *EncryptionConfig `yaml:"encryption"`    // s3, gcp, azure and alioss
+}
+
+type EncryptionType string
+
+const (
+	EncryptionTypeSSES3  EncryptionType = "sse-s3"  // keys managed by the storage provider
+	EncryptionTypeSSEKMS EncryptionType = "sse-kms" // keys managed by a key management service
+	EncryptionTypeSSEC   EncryptionType = "sse-c"   // customer provided keys
+)
+
+type EncryptionConfig struct {
+	Type        EncryptionType `yaml:"type"`
+	KMSKeyID    string         `yaml:"kms_key_id"`   // s3 and alioss kms key, gcp kms key name, or azure encryption scope
+	CustomerKey string         `yaml:"customer_key"` // base64 encoded 256 bit key, for sse-c
+
+	customerKey []byte
+}
+
+// GetCustomerKey returns the decoded customer key
+func (c *EncryptionConfig) GetCustomerKey() []byte {
+	return c.customerKey
+}
+
+func (s *StorageConfig) toUpload() interface{} {
+	if s.S3 != nil {
+		return &livekit.S3Upload{
+			AccessKey:      s.S3.AccessKey,
+			Secret:         s.S3.Secret,
+			Region:         s.S3.Region,
+			Endpoint:       s.S3.Endpoint,
+			Bucket:         s.S3.Bucket,
+			ForcePathStyle: s.S3.ForcePathStyle,
+		}
+	} else if s.GCP != nil {
+		var credentials []byte
+		if s.GCP.CredentialsJSON != "" {
+			credentials = []byte(s.GCP.CredentialsJSON)
+		}
+		return &livekit.GCPUpload{
+			Credentials: credentials,
+			Bucket:      s.GCP.Bucket,
+		}
+	} else if s.Azure != nil {
+		return &livekit.AzureBlobUpload{
+			AccountName:   s.Azure.AccountName,
+			AccountKey:    s.Azure.AccountKey,
+			ContainerName: s.Azure.ContainerName,
+		}
+	} else if s.AliOSS != nil {
+		return &livekit.AliOSSUpload{
+			AccessKey: s.AliOSS.AccessKey,
+			Secret:    s.AliOSS.Secret,
+			Region:    s.AliOSS.Region,
+			Endpoint:  s.AliOSS.Endpoint,
+			Bucket:    s.AliOSS.Bucket,
+		}
+	} else if s.Local != nil {
+		return s.Local
+	} else if s.HTTP != nil {
+		return s.HTTP
+	} else if s.SFTP != nil {
+		return s.SFTP
+	}
+	return nil
+}
+
 type SessionLimits struct {
 	FileOutputMaxDuration          time.Duration `yaml:"file_output_max_duration"`
 	StreamOutputMaxDuration        time.Duration `yaml:"stream_output_max_duration"`
@@ -89,6 +347,110 @@ type CPUCostConfig struct {
 	WebCpuCost            float64 `yaml:"web_cpu_cost"`
 }
 
+type MemoryCostConfig struct {
+	RoomCompositeMemoryCost  float64 `yaml:"room_composite_memory_cost"`
+	WebMemoryCost            float64 `yaml:"web_memory_cost"`
+	TrackCompositeMemoryCost float64 `yaml:"track_composite_memory_cost"`
+	TrackMemoryCost          float64 `yaml:"track_memory_cost"`
+	MinFreeMB                uint64  `yaml:"min_free_mb"` // memory kept free for the service and the os
+}
+
+type WatchdogConfig struct {
+	StallTimeout  time.Duration `yaml:"stall_timeout"`  // disabled when 0
+	MaxRecoveries int           `yaml:"max_recoveries"` // chrome reloads before ending the egress
+}
+
+type DiskConfig struct {
+	MinFreeMB         uint64        `yaml:"min_free_mb"`        // free space required after accepting a request
+	StopFreeMB        uint64        `yaml:"stop_free_mb"`       // active egresses are stopped below this
+	EstimatedDuration time.Duration `yaml:"estimated_duration"` // used when no session limit is set
+}
+
+type WarmPoolConfig struct {
+	Size   int   `yaml:"size"` // disabled when 0
+	Width  int32 `yaml:"width"`
+	Height int32 `yaml:"height"`
+	Depth  int32 `yaml:"depth"`
+}
+
+type HandlerPoolConfig struct {
+	Size    int `yaml:"size"`     // disabled when 0
+	MaxUses int `yaml:"max_uses"` // requests handled by a process before it is replaced
+}
+
+type ResourceLimitsConfig struct {
+	CgroupPath     string        `yaml:"cgroup_path"` // a cgroup v2 directory delegated to the egress service
+	RoomComposite  ResourceLimit `yaml:"room_composite"`
+	Web            ResourceLimit `yaml:"web"`
+	TrackComposite ResourceLimit `yaml:"track_composite"`
+	Track          ResourceLimit `yaml:"track"`
+}
+
+type ResourceLimit struct {
+	CPU      float64 `yaml:"cpu"`       // cpu cores. Unlimited when 0
+	MemoryMB uint64  `yaml:"memory_mb"` // unlimited when 0
+	Nice     int     `yaml:"nice"`      // used when cgroups are unavailable
+}
+
+// QueueConfig holds requests which can't be accepted right away. Callers stop waiting for a response
+// once egress.RequestExpiration (2s) has passed since the request was sent, so MaxWait is capped there
+// and the queue only absorbs short bursts, not sustained overload
+type QueueConfig struct {
+	Size     int                 `yaml:"size"`     // disabled when 0
+	MaxWait  time.Duration       `yaml:"max_wait"` // measured from when the request was sent, at most 2s
+	Priority QueuePriorityConfig `yaml:"priority"` // higher is claimed first. Overridden by request metadata
+}
+
+type QueuePriorityConfig struct {
+	RoomComposite  int `yaml:"room_composite"`
+	Web            int `yaml:"web"`
+	TrackComposite int `yaml:"track_composite"`
+	Track          int `yaml:"track"`
+}
+
+type ReplicationConfig struct {
+	Storage []string `yaml:"storage"` // names of storage profiles
+	Quorum  int      `yaml:"quorum"`  // destinations which must succeed, including the primary. Defaults to all
+}
+
+// TenantConfig matches requests by api key, room name prefix, or {"egress_tenant": name} in the request metadata
+type TenantConfig struct {
+	Name          string        `yaml:"name"`
+	ApiKey        string        `yaml:"api_key"`
+	ApiSecret     string        `yaml:"api_secret"` // verifies tokens signed with api_key. Not needed for the node's key
+	RoomPrefix    string        `yaml:"room_prefix"`
+	MaxConcurrent int           `yaml:"max_concurrent"` // unlimited when 0
+	MaxMinutes    float64       `yaml:"max_minutes"`    // recording minutes per window. Unlimited when 0
+	Window        time.Duration `yaml:"window"`
+	MaxStreams    int           `yaml:"max_streams"` // stream destinations per egress. Unlimited when 0
+}
+
+type JanitorConfig struct {
+	Interval  time.Duration `yaml:"interval"`  // time between scans of the local directory
+	Retention time.Duration `yaml:"retention"` // orphaned files older than this are deleted
+}
+
+type UploadTimeoutConfig struct {
+	Object time.Duration `yaml:"object"` // each file at each destination, including retries
+	Total  time.Duration `yaml:"total"`  // all uploads after the egress ends
+}
+
+// ClientEncryptionConfig wraps the data key of each file with an rsa public key or a kms key. Only one should be set
+type ClientEncryptionConfig struct {
+	PublicKey  string     `yaml:"public_key"`  // pem encoded rsa public key
+	PrivateKey string     `yaml:"private_key"` // pem encoded rsa private key, only needed to decrypt
+	KMS        *KMSConfig `yaml:"kms"`
+	ChunkSize  int        `yaml:"chunk_size"` // bytes encrypted at a time
+}
+
+type KMSConfig struct {
+	KeyID     string `yaml:"key_id"` // key id, arn or alias
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key"` // (env AWS_ACCESS_KEY_ID)
+	Secret    string `yaml:"secret"`     // (env AWS_SECRET_ACCESS_KEY)
+	Endpoint  string `yaml:"endpoint"`
+}
+
 func NewConfig(confString string) (*Config, error) {
 	conf := &Config{
 		LogLevel:     "info",
@@ -104,37 +466,74 @@ func NewConfig(confString string) (*Config, error) {
 		}
 	}
 
-	if conf.S3 != nil {
-		conf.FileUpload = &livekit.S3Upload{
-			AccessKey:      conf.S3.AccessKey,
-			Secret:         conf.S3.Secret,
-			Region:         conf.S3.Region,
-			Endpoint:       conf.S3.Endpoint,
-			Bucket:         conf.S3.Bucket,
-			ForcePathStyle: conf.S3.ForcePathStyle,
+	if conf.Local != nil {
+		if err := conf.Local.validate(); err != nil {
+			return nil, errors.ErrCouldNotParseConfig(err)
 		}
-	} else if conf.GCP != nil {
-		var credentials []byte
-		if conf.GCP.CredentialsJSON != "" {
-			credentials = []byte(conf.GCP.CredentialsJSON)
+	}
+	if conf.HTTP != nil {
+		if err := conf.HTTP.validate(); err != nil {
+			return nil, errors.ErrCouldNotParseConfig(err)
 		}
-		conf.FileUpload = &livekit.GCPUpload{
-			Credentials: credentials,
-			Bucket:      conf.GCP.Bucket,
+	}
+	if conf.SFTP != nil {
+		if err := conf.SFTP.validate(); err != nil {
+			return nil, errors.ErrCouldNotParseConfig(err)
+		}
+	}
+
+	conf.FileUpload = (&StorageConfig{
+		S3:     conf.S3,
+		Azure:  conf.Azure,
+		GCP:    conf.GCP,
+		AliOSS: conf.AliOSS,
+		Local:  conf.Local,
+		HTTP:   conf.HTTP,
+		SFTP:   conf.SFTP,
+	}).toUpload()
+	if err := conf.Location.validate(conf.FileUpload); err != nil {
+		return nil, errors.ErrCouldNotParseConfig(err)
+	}
+	if err := conf.ObjectOptions.validate(conf.FileUpload); err != nil {
+		return nil, errors.ErrCouldNotParseConfig(err)
+	}
+
+	conf.storageUploads = make(map[string]interface{})
+	conf.storageLocations = make(map[string]LocationConfig)
+	conf.storageOptions = make(map[string]ObjectOptionsConfig)
+	for name, storage := range conf.Storage {
+		if storage.Local != nil {
+			if err := storage.Local.validate(); err != nil {
+				return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("storage profile %s: %v", name, err))
+			}
+		}
+		if storage.HTTP != nil {
+			if err := storage.HTTP.validate(); err != nil {
+				return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("storage profile %s: %v", name, err))
+			}
 		}
-	} else if conf.Azure != nil {
-		conf.FileUpload = &livekit.AzureBlobUpload{
-			AccountName:   conf.Azure.AccountName,
-			AccountKey:    conf.Azure.AccountKey,
-			ContainerName: conf.Azure.ContainerName,
+		if storage.SFTP != nil {
+			if err := storage.SFTP.validate(); err != nil {
+				return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("storage profile %s: %v", name, err))
+			}
 		}
-	} else if conf.AliOSS != nil {
-		conf.FileUpload = &livekit.AliOSSUpload{
-			AccessKey: conf.AliOSS.AccessKey,
-			Secret:    conf.AliOSS.Secret,
-			Region:    conf.AliOSS.Region,
-			Endpoint:  conf.AliOSS.Endpoint,
-			Bucket:    conf.AliOSS.Bucket,
+		upload := storage.toUpload()
+		if upload == nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("storage profile %s has no storage", name))
+		}
+		if err := storage.Location.validate(upload); err != nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("storage profile %s: %v", name, err))
+		}
+		if err := storage.ObjectOptions.validate(upload); err != nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("storage profile %s: %v", name, err))
+		}
+		conf.storageUploads[name] = upload
+		conf.storageLocations[name] = storage.Location
+		conf.storageOptions[name] = storage.ObjectOptions
+	}
+	for _, name := range conf.Replication.Storage {
+		if conf.storageUploads[name] == nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("replication storage %s not found", name))
 		}
 	}
 
@@ -155,6 +554,84 @@ func NewConfig(confString string) (*Config, error) {
 		conf.CPUCost.FileAndStreamCpuCost = fileAndStreamCpuCost // a new check for the new type
 	}
 
+	if conf.MemoryCost.RoomCompositeMemoryCost <= 0 {
+		conf.MemoryCost.RoomCompositeMemoryCost = roomCompositeMemoryCost
+	}
+	if conf.MemoryCost.WebMemoryCost <= 0 {
+		conf.MemoryCost.WebMemoryCost = webMemoryCost
+	}
+	if conf.MemoryCost.TrackCompositeMemoryCost <= 0 {
+		conf.MemoryCost.TrackCompositeMemoryCost = trackCompositeMemoryCost
+	}
+	if conf.MemoryCost.TrackMemoryCost <= 0 {
+		conf.MemoryCost.TrackMemoryCost = trackMemoryCost
+	}
+	if conf.MemoryCost.MinFreeMB == 0 {
+		conf.MemoryCost.MinFreeMB = memoryMinFreeMB
+	}
+
+	if conf.Watchdog.MaxRecoveries <= 0 {
+		conf.Watchdog.MaxRecoveries = watchdogMaxRecoveries
+	}
+
+	if conf.Disk.MinFreeMB == 0 {
+		conf.Disk.MinFreeMB = diskMinFreeMB
+	}
+	if conf.Disk.StopFreeMB == 0 {
+		conf.Disk.StopFreeMB = diskStopFreeMB
+	}
+	if conf.Disk.EstimatedDuration <= 0 {
+		conf.Disk.EstimatedDuration = diskEstimatedDuration
+	}
+
+	if conf.WarmPool.Width <= 0 {
+		conf.WarmPool.Width = warmPoolWidth
+	}
+	if conf.WarmPool.Height <= 0 {
+		conf.WarmPool.Height = warmPoolHeight
+	}
+	if conf.WarmPool.Depth <= 0 {
+		conf.WarmPool.Depth = warmPoolDepth
+	}
+
+	if conf.HandlerPool.MaxUses <= 0 {
+		conf.HandlerPool.MaxUses = handlerPoolMaxUses
+	}
+
+	if conf.ResourceLimits.CgroupPath == "" {
+		conf.ResourceLimits.CgroupPath = resourceLimitsCgroupPath
+	}
+
+	// requests are dropped once they expire, so they can't be queued for any longer
+	if conf.Queue.MaxWait <= 0 || conf.Queue.MaxWait > egress.RequestExpiration {
+		conf.Queue.MaxWait = egress.RequestExpiration
+	}
+
+	for _, tenant := range conf.Tenants {
+		if tenant.Window <= 0 {
+			tenant.Window = tenantWindow
+		}
+	}
+
+	if conf.Janitor.Interval <= 0 {
+		conf.Janitor.Interval = janitorInterval
+	}
+	if conf.Janitor.Retention <= 0 {
+		conf.Janitor.Retention = janitorRetention
+	}
+	if conf.UploadTimeout.Object <= 0 {
+		conf.UploadTimeout.Object = uploadObjectTimeout
+	}
+	if conf.UploadTimeout.Total <= 0 {
+		conf.UploadTimeout.Total = uploadTotalTimeout
+	}
+
+	if conf.ClientEncryption != nil {
+		if err := conf.ClientEncryption.validate(); err != nil {
+			return nil, errors.ErrCouldNotParseConfig(err)
+		}
+	}
+
 	conf.LocalOutputDirectory = path.Clean(conf.LocalOutputDirectory)
 	if conf.LocalOutputDirectory == "." {
 		conf.LocalOutputDirectory = os.TempDir()
@@ -175,6 +652,7 @@ func (c *Config) initLogger() error {
 			conf.Level = zap.NewAtomicLevelAt(lvl)
 		}
 	}
+	c.logLevel = conf.Level
 
 	l, _ := conf.Build()
 
@@ -182,3 +660,182 @@ func (c *Config) initLogger() error {
 	lksdk.SetLogger(logger.GetLogger())
 	return nil
 }
+
+func (c *LocalConfig) validate() error {
+	if !path.IsAbs(c.Root) {
+		return fmt.Errorf("local root must be an absolute path")
+	}
+	if c.FileMode != "" {
+		mode, err := strconv.ParseUint(c.FileMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid file_mode %s", c.FileMode)
+		}
+		c.fileMode = os.FileMode(mode).Perm()
+	}
+	return nil
+}
+
+func (c *HTTPConfig) validate() error {
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("invalid http url %s", c.URL)
+	}
+	switch c.Method {
+	case "":
+		c.Method = "PUT"
+	case "PUT", "POST":
+	default:
+		return fmt.Errorf("unsupported http method %s", c.Method)
+	}
+	return nil
+}
+
+func (c *SFTPConfig) validate() error {
+	if c.Host == "" || c.Username == "" {
+		return fmt.Errorf("sftp host and username are required")
+	}
+	if c.Password == "" && c.PrivateKey == "" {
+		return fmt.Errorf("sftp password or private_key is required")
+	}
+	if c.HostKey == "" {
+		return fmt.Errorf("sftp host_key is required")
+	}
+	if _, _, err := net.SplitHostPort(c.Host); err != nil {
+		c.Host = net.JoinHostPort(c.Host, "22")
+	}
+	return nil
+}
+
+func (c *LocationConfig) validate(upload interface{}) error {
+	if c.CDNBaseURL != "" {
+		if !strings.HasPrefix(c.CDNBaseURL, "http://") && !strings.HasPrefix(c.CDNBaseURL, "https://") {
+			return fmt.Errorf("invalid cdn_base_url %s", c.CDNBaseURL)
+		}
+		c.CDNBaseURL = strings.TrimSuffix(c.CDNBaseURL, "/")
+	}
+	if c.PresignExpiry > 0 {
+		switch upload.(type) {
+		case *livekit.S3Upload, *livekit.GCPUpload, *livekit.AzureBlobUpload, *livekit.AliOSSUpload:
+		default:
+			return fmt.Errorf("presign_expiry is not supported by this storage")
+		}
+	}
+	return nil
+}
+
+func (c *ObjectOptionsConfig) validate(upload interface{}) error {
+	for _, kind := range []ObjectKind{ObjectKindFile, ObjectKindSegment, ObjectKindPlaylist, ObjectKindManifest} {
+		if err := c.Get(kind).Encryption.validate(upload); err != nil {
+			return fmt.Errorf("%s object options: %v", kind, err)
+		}
+	}
+	return nil
+}
+
+func (c *EncryptionConfig) validate(upload interface{}) error {
+	if c == nil {
+		return nil
+	}
+
+	switch upload.(type) {
+	case *livekit.S3Upload, *livekit.GCPUpload, *livekit.AzureBlobUpload, *livekit.AliOSSUpload:
+	default:
+		return fmt.Errorf("encryption is not supported by this storage")
+	}
+
+	switch c.Type {
+	case EncryptionTypeSSES3:
+	case EncryptionTypeSSEKMS:
+		// s3 and alioss fall back to their default kms key
+		switch upload.(type) {
+		case *livekit.GCPUpload, *livekit.AzureBlobUpload:
+			if c.KMSKeyID == "" {
+				return fmt.Errorf("kms_key_id is required")
+			}
+		}
+	case EncryptionTypeSSEC:
+		key, err := base64.StdEncoding.DecodeString(c.CustomerKey)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("customer_key must be a base64 encoded 256 bit key")
+		}
+		c.customerKey = key
+	default:
+		return fmt.Errorf("unsupported encryption type %s", c.Type)
+	}
+	return nil
+}
+
+// Get returns the options for a kind of object
+func (c ObjectOptionsConfig) Get(kind ObjectKind) *ObjectOptions {
+	switch kind {
+	case ObjectKindSegment:
+		return &c.Segment
+	case ObjectKindPlaylist:
+		return &c.Playlist
+	case ObjectKindManifest:
+		return &c.Manifest
+	default:
+		return &c.File
+	}
+}
+
+func (c *ClientEncryptionConfig) validate() error {
+	if c.PublicKey == "" && c.PrivateKey == "" && c.KMS == nil {
+		return fmt.Errorf("client encryption requires a public_key, private_key or kms")
+	}
+	if c.KMS != nil && c.KMS.KeyID == "" {
+		return fmt.Errorf("kms key_id is required")
+	}
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = clientEncryptionChunkSize
+	}
+	return nil
+}
+
+// GetApiSecret returns the secret of the node's api key or of a tenant's api key, and false if the key is unknown
+func (c *Config) GetApiSecret(apiKey string) (string, bool) {
+	if apiKey == "" {
+		return "", false
+	}
+	if apiKey == c.ApiKey {
+		return c.ApiSecret, true
+	}
+	for _, tenant := range c.Tenants {
+		if tenant.ApiKey == apiKey && tenant.ApiSecret != "" {
+			return tenant.ApiSecret, true
+		}
+	}
+	return "", false
+}
+
+// GetStorage returns the upload config of a named storage profile, or nil if it does not exist
+func (c *Config) GetStorage(name string) interface{} {
+	return c.storageUploads[name]
+}
+
+// GetLocation returns the location config of a named storage profile, or of the default storage when name is empty
+func (c *Config) GetLocation(name string) LocationConfig {
+	if name == "" {
+		return c.Location
+	}
+	return c.storageLocations[name]
+}
+
+// GetObjectOptions returns the object options of a named storage profile, or of the default storage when name is empty
+func (c *Config) GetObjectOptions(name string) ObjectOptionsConfig {
+	if name == "" {
+		return c.ObjectOptions
+	}
+	return c.storageOptions[name]
+}
+
+// SetLogLevel changes the log level without rebuilding the logger
+func (c *Config) SetLogLevel(level string) error {
+	lvl := zapcore.Level(0)
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+
+	c.logLevel.SetLevel(lvl)
+	c.LogLevel = level
+	return nil
+}
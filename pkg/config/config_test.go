@@ -0,0 +1,37 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolvePath(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		root            string
+		storageFilepath string
+		expected        string
+	}{
+		{name: "file", root: "/data", storageFilepath: "room/recording.mp4", expected: "/data/room/recording.mp4"},
+		{name: "trailing slash", root: "/data/", storageFilepath: "recording.mp4", expected: "/data/recording.mp4"},
+		{name: "root", root: "/", storageFilepath: "data/recording.mp4", expected: "/data/recording.mp4"},
+		{name: "root escape", root: "/", storageFilepath: "../recording.mp4", expected: "/recording.mp4"},
+		{name: "dotted filename", root: "/data", storageFilepath: "..recording.mp4", expected: "/data/..recording.mp4"},
+		{name: "escape", root: "/data", storageFilepath: "../etc/passwd"},
+		{name: "nested escape", root: "/data", storageFilepath: "room/../../etc/passwd"},
+		{name: "sibling", root: "/data", storageFilepath: "../data2/recording.mp4"},
+		{name: "root directory", root: "/data/", storageFilepath: "room/.."},
+		{name: "empty", root: "/", storageFilepath: ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dest, err := (&LocalConfig{Root: test.root}).ResolvePath(test.storageFilepath)
+			if test.expected == "" {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, test.expected, dest)
+			}
+		})
+	}
+}
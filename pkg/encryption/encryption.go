@@ -0,0 +1,275 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+)
+
+// Encrypted files start with a magic string and a json header holding the wrapped data key, followed by the
+// plaintext in chunks, each sealed with AES-256-GCM. The nonce of each chunk is a random prefix, the chunk
+// counter and a final chunk flag, so that reordered, dropped or truncated chunks fail to decrypt.
+// The header is authenticated as additional data of every chunk.
+
+const (
+	Algorithm = "AES-256-GCM"
+
+	magic           = "LKENC\x01"
+	noncePrefixSize = 7
+	dataKeySize     = 32
+	maxHeaderSize   = 64 * 1024
+)
+
+type Header struct {
+	Algorithm   string `json:"algorithm"`
+	KeyID       string `json:"key_id"`
+	WrappedKey  []byte `json:"wrapped_key"`
+	ChunkSize   int    `json:"chunk_size"`
+	NoncePrefix []byte `json:"nonce_prefix"`
+}
+
+// EncryptFile encrypts src into dst with a new data key, and returns the id of the key which wrapped it
+func EncryptFile(ctx context.Context, provider KeyProvider, src, dst string, chunkSize int) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+
+	keyID, err := Encrypt(ctx, provider, out, in, chunkSize)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return "", err
+	}
+	return keyID, nil
+}
+
+// Encrypt reads r until EOF and writes the encrypted file to w
+func Encrypt(ctx context.Context, provider KeyProvider, w io.Writer, r io.Reader, chunkSize int) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	keyID, wrappedKey, err := provider.WrapKey(ctx, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	header := &Header{
+		Algorithm:   Algorithm,
+		KeyID:       keyID,
+		WrappedKey:  wrappedKey,
+		ChunkSize:   chunkSize,
+		NoncePrefix: make([]byte, noncePrefixSize),
+	}
+	if _, err = rand.Read(header.NoncePrefix); err != nil {
+		return "", err
+	}
+
+	aad, err := marshalHeader(header)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(aad); err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext := make([]byte, chunkSize)
+	sealed := make([]byte, 0, chunkSize+aead.Overhead())
+	br := bufio.NewReaderSize(r, chunkSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, plaintext)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+
+		// a full chunk is only final if nothing follows it
+		final := err != nil
+		if !final {
+			if _, err = br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return "", err
+			}
+		}
+
+		sealed = aead.Seal(sealed[:0], nonce(header.NoncePrefix, counter, final), plaintext[:n], aad)
+		if _, err = w.Write(sealed); err != nil {
+			return "", err
+		}
+		if final {
+			return keyID, nil
+		}
+		if err = ctx.Err(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// DecryptFile decrypts src into dst. dst is removed if the file can't be fully authenticated
+func DecryptFile(ctx context.Context, provider KeyProvider, src, dst string) (*Header, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := Decrypt(ctx, provider, out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return nil, err
+	}
+	return header, nil
+}
+
+// Decrypt reads an encrypted file from r and writes the plaintext to w. Each chunk is authenticated before
+// it is written, but w should be discarded on error since earlier chunks will have been written
+func Decrypt(ctx context.Context, provider KeyProvider, w io.Writer, r io.Reader) (*Header, error) {
+	br := bufio.NewReader(r)
+	header, aad, err := ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if header.Algorithm != Algorithm || header.ChunkSize <= 0 || len(header.NoncePrefix) != noncePrefixSize {
+		return nil, errors.ErrDecryptionFailed
+	}
+
+	dataKey, err := provider.UnwrapKey(ctx, header.KeyID, header.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, header.ChunkSize+aead.Overhead())
+	plaintext := make([]byte, 0, header.ChunkSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, sealed)
+		if err == io.EOF {
+			// the final chunk is missing
+			return nil, errors.ErrDecryptionFailed
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		final := err != nil
+		if !final {
+			if _, err = br.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		plaintext, err = aead.Open(plaintext[:0], nonce(header.NoncePrefix, counter, final), sealed[:n], aad)
+		if err != nil {
+			return nil, errors.ErrDecryptionFailed
+		}
+		if _, err = w.Write(plaintext); err != nil {
+			return nil, err
+		}
+		if final {
+			return header, nil
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ReadHeader reads the header of an encrypted file, returning it along with its raw bytes
+func ReadHeader(r io.Reader) (*Header, []byte, error) {
+	prefix := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil, errors.ErrNotEncrypted
+		}
+		return nil, nil, err
+	}
+	if !bytes.Equal(prefix[:len(magic)], []byte(magic)) {
+		return nil, nil, errors.ErrNotEncrypted
+	}
+
+	size := binary.BigEndian.Uint32(prefix[len(magic):])
+	if size > maxHeaderSize {
+		return nil, nil, errors.ErrDecryptionFailed
+	}
+	raw := make([]byte, len(prefix)+int(size))
+	copy(raw, prefix)
+	if _, err := io.ReadFull(r, raw[len(prefix):]); err != nil {
+		return nil, nil, errors.ErrDecryptionFailed
+	}
+
+	header := &Header{}
+	if err := json.Unmarshal(raw[len(prefix):], header); err != nil {
+		return nil, nil, errors.ErrDecryptionFailed
+	}
+	return header, raw, nil
+}
+
+func marshalHeader(header *Header) ([]byte, error) {
+	b, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, len(magic)+4, len(magic)+4+len(b))
+	copy(raw, magic)
+	binary.BigEndian.PutUint32(raw[len(magic):], uint32(len(b)))
+	return append(raw, b...), nil
+}
+
+func newAEAD(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(prefix []byte, counter uint32, final bool) []byte {
+	n := make([]byte, noncePrefixSize+5)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[noncePrefixSize:], counter)
+	if final {
+		n[noncePrefixSize+4] = 1
+	}
+	return n
+}
@@ -0,0 +1,78 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+)
+
+const testChunkSize = 1024
+
+func TestEncryption(t *testing.T) {
+	provider := newTestKeyProvider(t)
+
+	for _, size := range []int{0, 1, testChunkSize - 1, testChunkSize, testChunkSize*2 + 5} {
+		plaintext := make([]byte, size)
+		_, err := rand.Read(plaintext)
+		require.NoError(t, err)
+
+		encrypted := &bytes.Buffer{}
+		keyID, err := Encrypt(context.Background(), provider, encrypted, bytes.NewReader(plaintext), testChunkSize)
+		require.NoError(t, err)
+		require.Equal(t, provider.keyID, keyID)
+
+		decrypted := &bytes.Buffer{}
+		header, err := Decrypt(context.Background(), provider, decrypted, bytes.NewReader(encrypted.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, keyID, header.KeyID)
+		require.Equal(t, size, decrypted.Len())
+		require.True(t, bytes.Equal(plaintext, decrypted.Bytes()))
+	}
+
+	plaintext := make([]byte, testChunkSize*3)
+	encrypted := &bytes.Buffer{}
+	_, err := Encrypt(context.Background(), provider, encrypted, bytes.NewReader(plaintext), testChunkSize)
+	require.NoError(t, err)
+	b := encrypted.Bytes()
+
+	t.Run("truncated", func(t *testing.T) {
+		// drop the final chunk
+		_, err := Decrypt(context.Background(), provider, &bytes.Buffer{}, bytes.NewReader(b[:len(b)-testChunkSize-16]))
+		require.ErrorIs(t, err, errors.ErrDecryptionFailed)
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		modified := append([]byte{}, b...)
+		modified[len(modified)-1] ^= 1
+		_, err := Decrypt(context.Background(), provider, &bytes.Buffer{}, bytes.NewReader(modified))
+		require.ErrorIs(t, err, errors.ErrDecryptionFailed)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		_, err := Decrypt(context.Background(), newTestKeyProvider(t), &bytes.Buffer{}, bytes.NewReader(b))
+		require.Error(t, err)
+	})
+
+	t.Run("not encrypted", func(t *testing.T) {
+		_, err := Decrypt(context.Background(), provider, &bytes.Buffer{}, bytes.NewReader(plaintext))
+		require.ErrorIs(t, err, errors.ErrNotEncrypted)
+	})
+}
+
+func newTestKeyProvider(t *testing.T) *rsaKeyProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	provider, err := newRSAKeyProvider("", string(pem.EncodeToMemory(block)))
+	require.NoError(t, err)
+	return provider
+}
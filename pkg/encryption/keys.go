@@ -0,0 +1,170 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+)
+
+// KeyProvider wraps the data key of each file
+type KeyProvider interface {
+	// WrapKey encrypts a data key, and returns the id of the key which wrapped it
+	WrapKey(ctx context.Context, dataKey []byte) (keyID string, wrappedKey []byte, err error)
+	UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+func NewKeyProvider(conf *config.ClientEncryptionConfig) (KeyProvider, error) {
+	if conf.KMS != nil {
+		return newKMSKeyProvider(conf.KMS)
+	}
+	return newRSAKeyProvider(conf.PublicKey, conf.PrivateKey)
+}
+
+// rsaKeyProvider wraps data keys with RSA-OAEP. The private key is only needed to unwrap them
+type rsaKeyProvider struct {
+	keyID      string
+	publicKey  *rsa.PublicKey
+	privateKey *rsa.PrivateKey
+}
+
+func newRSAKeyProvider(publicKeyPEM, privateKeyPEM string) (*rsaKeyProvider, error) {
+	p := &rsaKeyProvider{}
+
+	if privateKeyPEM != "" {
+		block, _ := pem.Decode([]byte(privateKeyPEM))
+		if block == nil {
+			return nil, fmt.Errorf("invalid private key")
+		}
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if key, ok = parsed.(*rsa.PrivateKey); !ok {
+				return nil, fmt.Errorf("private key is not an rsa key")
+			}
+		}
+		p.privateKey = key
+		p.publicKey = &key.PublicKey
+	}
+
+	if publicKeyPEM != "" {
+		block, _ := pem.Decode([]byte(publicKeyPEM))
+		if block == nil {
+			return nil, fmt.Errorf("invalid public key")
+		}
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if key, ok = parsed.(*rsa.PublicKey); !ok {
+				return nil, fmt.Errorf("public key is not an rsa key")
+			}
+		}
+		if p.publicKey != nil && !p.publicKey.Equal(key) {
+			return nil, fmt.Errorf("public key does not match private key")
+		}
+		p.publicKey = key
+	}
+
+	if p.publicKey == nil {
+		return nil, fmt.Errorf("rsa public or private key is required")
+	}
+
+	// the key id is the fingerprint of the public key
+	der, err := x509.MarshalPKIXPublicKey(p.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	p.keyID = "rsa:" + hex.EncodeToString(sum[:16])
+
+	return p, nil
+}
+
+func (p *rsaKeyProvider) WrapKey(_ context.Context, dataKey []byte) (string, []byte, error) {
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, p.publicKey, dataKey, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return p.keyID, wrappedKey, nil
+}
+
+func (p *rsaKeyProvider) UnwrapKey(_ context.Context, keyID string, wrappedKey []byte) ([]byte, error) {
+	if keyID != p.keyID {
+		return nil, errors.ErrEncryptionKeyMismatch(keyID)
+	}
+	if p.privateKey == nil {
+		return nil, fmt.Errorf("private key is required to decrypt")
+	}
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, p.privateKey, wrappedKey, nil)
+}
+
+// kmsKeyProvider wraps data keys with an aws kms key
+type kmsKeyProvider struct {
+	keyID string
+	svc   *kms.KMS
+}
+
+func newKMSKeyProvider(conf *config.KMSConfig) (*kmsKeyProvider, error) {
+	awsConfig := &aws.Config{
+		Region: aws.String(conf.Region),
+	}
+	if conf.AccessKey != "" && conf.Secret != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(conf.AccessKey, conf.Secret, "")
+	}
+	if conf.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(conf.Endpoint)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kmsKeyProvider{
+		keyID: conf.KeyID,
+		svc:   kms.New(sess),
+	}, nil
+}
+
+func (p *kmsKeyProvider) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	res, err := p.svc.EncryptWithContext(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(p.keyID),
+		Plaintext: dataKey,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return aws.StringValue(res.KeyId), res.CiphertextBlob, nil
+}
+
+func (p *kmsKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error) {
+	// the wrapped key identifies its kms key, which may no longer match an alias in the config
+	res, err := p.svc.DecryptWithContext(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(keyID),
+		CiphertextBlob: wrappedKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Plaintext, nil
+}
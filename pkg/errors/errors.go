@@ -3,6 +3,7 @@ package errors
 import (
 	"errors"
 	"fmt"
+	"time"
 )
 
 var (
@@ -11,6 +12,10 @@ var (
 	ErrGhostPadFailed      = errors.New("failed to add ghost pad to bin")
 	ErrStreamAlreadyExists = errors.New("stream already exists")
 	ErrStreamNotFound      = errors.New("stream not found")
+	ErrNoDisplayAvailable  = errors.New("no display available")
+	ErrEgressKilled        = errors.New("egress killed")
+	ErrNotEncrypted        = errors.New("file is not encrypted")
+	ErrDecryptionFailed    = errors.New("decryption failed, the file is corrupt, truncated or was encrypted with a different key")
 )
 
 func New(err string) error {
@@ -41,6 +46,18 @@ func ErrInvalidUrl(url, protocol string) error {
 	return fmt.Errorf("invalid %s url: %s", protocol, url)
 }
 
+func ErrEncryptionKeyMismatch(keyID string) error {
+	return fmt.Errorf("file was encrypted with key %s", keyID)
+}
+
+func ErrChecksumMismatch(checksum, expected, actual string) error {
+	return fmt.Errorf("stored object %s %s does not match %s", checksum, actual, expected)
+}
+
+func ErrStorageNotFound(name string) error {
+	return fmt.Errorf("storage %s not found", name)
+}
+
 func ErrTrackNotFound(trackID string) error {
 	return fmt.Errorf("track %s not found", trackID)
 }
@@ -57,6 +74,46 @@ func ErrUploadFailed(location string, err error) error {
 	return fmt.Errorf("%s upload failed: %v", location, err)
 }
 
+func ErrUploadQuorum(succeeded, quorum int, err error) error {
+	return fmt.Errorf("uploaded to %d of %d required destinations: %v", succeeded, quorum, err)
+}
+
+func ErrDiskFull(free uint64) error {
+	return fmt.Errorf("local disk nearly full, %d bytes remaining", free)
+}
+
+type quotaExceededError struct {
+	msg string
+}
+
+func (e *quotaExceededError) Error() string {
+	return e.msg
+}
+
+func ErrQuotaExceeded(tenant, quota string, limit interface{}) error {
+	return &quotaExceededError{msg: fmt.Sprintf("tenant %s exceeded its %s quota of %v", tenant, quota, limit)}
+}
+
+func IsQuotaExceeded(err error) bool {
+	var e *quotaExceededError
+	return errors.As(err, &e)
+}
+
+func ErrInvalidLabel(name string) error {
+	return fmt.Errorf("invalid node label: %s", name)
+}
+
+func ErrHandlerExited(err error) error {
+	if err == nil {
+		return errors.New("handler exited without completing egress")
+	}
+	return fmt.Errorf("handler exited unexpectedly: %v", err)
+}
+
+func ErrPipelineStalled(element string, duration time.Duration) error {
+	return fmt.Errorf("%s stalled for %v", element, duration)
+}
+
 func ErrWebSocketClosed(addr string) error {
 	return errors.New(fmt.Sprintf("websocket already closed: %s", addr))
 }
@@ -148,7 +148,7 @@ func (a *AudioInput) buildWebDecoder(p *params.Params) error {
 	if err != nil {
 		return err
 	}
-	if err = pulseSrc.SetProperty("device", fmt.Sprintf("%s.monitor", p.Info.EgressId)); err != nil {
+	if err = pulseSrc.SetProperty("device", fmt.Sprintf("%s.monitor", p.PulseSink)); err != nil {
 		return err
 	}
 
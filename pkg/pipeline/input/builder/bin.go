@@ -16,6 +16,14 @@ import (
 
 const latency = uint64(41e8) // slightly larger than max audio latency
 
+// flow pad names
+const (
+	AudioSourcePad  = "audio source"
+	AudioEncoderPad = "audio encoder"
+	VideoSourcePad  = "video source"
+	VideoEncoderPad = "video encoder"
+)
+
 type InputBin struct {
 	bin *gst.Bin
 
@@ -168,6 +176,25 @@ func (b *InputBin) Element() *gst.Element {
 	return b.bin.Element
 }
 
+// GetFlowPads returns the source and encoder pads, which can be probed to verify that media is flowing
+func (b *InputBin) GetFlowPads() map[string]*gst.Pad {
+	pads := make(map[string]*gst.Pad)
+	if b.audio != nil {
+		pads[AudioSourcePad] = getSrcPad(b.audio.decoder[:1])
+		if b.audio.encoder != nil {
+			pads[AudioEncoderPad] = b.audio.encoder.GetStaticPad("src")
+		}
+	}
+	if b.video != nil {
+		pads[VideoSourcePad] = getSrcPad(b.video.elements[:1])
+		if pad := b.video.GetSrcPad(); pad != nil {
+			pads[VideoEncoderPad] = pad
+		}
+	}
+
+	return pads
+}
+
 func (b *InputBin) Link() error {
 	mqPad := 0
 
@@ -17,6 +17,7 @@ type Input interface {
 	Bin() *gst.Bin
 	Element() *gst.Element
 	Link() error
+	GetFlowPads() map[string]*gst.Pad
 	StartRecording() chan struct{}
 	EndRecording() chan struct{}
 	Close()
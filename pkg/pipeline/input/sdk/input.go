@@ -141,6 +141,13 @@ func (s *SDKInput) SendEOS() {
 	wg.Wait()
 }
 
+// WritePLI requests a key frame from the video publisher
+func (s *SDKInput) WritePLI() {
+	if s.videoWriter != nil && s.videoWriter.writePLI != nil {
+		s.videoWriter.writePLI()
+	}
+}
+
 func (s *SDKInput) SendAppSrcEOS(name string) {
 	if name == AudioAppSource {
 		s.audioWriter.sendEOS()
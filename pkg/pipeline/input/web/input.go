@@ -2,7 +2,6 @@ package web
 
 import (
 	"context"
-	"math/rand"
 	"os"
 	"os/exec"
 	"time"
@@ -24,7 +23,9 @@ type WebInput struct {
 
 	pulseSink    string
 	xvfb         *exec.Cmd
+	chromeCtx    context.Context
 	chromeCancel context.CancelFunc
+	chromeDir    string
 
 	startRecording chan struct{}
 	endRecording   chan struct{}
@@ -32,10 +33,6 @@ type WebInput struct {
 	logger logger.Logger
 }
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
 func NewWebInput(ctx context.Context, conf *config.Config, p *params.Params) (*WebInput, error) {
 	ctx, span := tracer.Start(ctx, "WebInput.New")
 	defer span.End()
@@ -44,16 +41,19 @@ func NewWebInput(ctx context.Context, conf *config.Config, p *params.Params) (*W
 		logger: p.Logger,
 	}
 
-	if err := s.createPulseSink(ctx, p); err != nil {
-		s.logger.Errorw("failed to load pulse sink", err)
-		s.Close()
-		return nil, err
-	}
+	// pre-launched environments already have their display and audio sink
+	if p.DevToolsUrl == "" {
+		if err := s.createPulseSink(ctx, p); err != nil {
+			s.logger.Errorw("failed to load pulse sink", err)
+			s.Close()
+			return nil, err
+		}
 
-	if err := s.launchXvfb(ctx, p); err != nil {
-		s.logger.Errorw("failed to launch xvfb", err)
-		s.Close()
-		return nil, err
+		if err := s.launchXvfb(ctx, p); err != nil {
+			s.logger.Errorw("failed to launch xvfb", err)
+			s.Close()
+			return nil, err
+		}
 	}
 
 	if err := s.launchChrome(ctx, p, conf.Insecure); err != nil {
@@ -82,12 +82,29 @@ func (s *WebInput) EndRecording() chan struct{} {
 	return s.endRecording
 }
 
+// Responsive returns false if chrome does not respond within the timeout
+func (s *WebInput) Responsive(timeout time.Duration) bool {
+	return s.chromeResponsive(timeout)
+}
+
+// Reload reloads the page being recorded
+func (s *WebInput) Reload(ctx context.Context) error {
+	return s.reloadChrome(ctx)
+}
+
 func (s *WebInput) Close() {
 	if s.chromeCancel != nil {
 		s.chromeCancel()
 		s.chromeCancel = nil
 	}
 
+	if s.chromeDir != "" {
+		if err := os.RemoveAll(s.chromeDir); err != nil {
+			s.logger.Errorw("failed to remove chrome profile", err)
+		}
+		s.chromeDir = ""
+	}
+
 	if s.xvfb != nil {
 		err := s.xvfb.Process.Signal(os.Interrupt)
 		if err != nil {
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/chromedp/cdproto/runtime"
 	"github.com/chromedp/chromedp"
@@ -23,20 +24,12 @@ func (s *WebInput) createPulseSink(ctx context.Context, p *params.Params) error
 	ctx, span := tracer.Start(ctx, "WebInput.createPulseSink")
 	defer span.End()
 
-	cmd := exec.Command("pactl",
-		"load-module", "module-null-sink",
-		fmt.Sprintf("sink_name=\"%s\"", p.Info.EgressId),
-		fmt.Sprintf("sink_properties=device.description=\"%s\"", p.Info.EgressId),
-	)
-	var b bytes.Buffer
-	cmd.Stdout = &b
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	module, err := CreatePulseSink(p.PulseSink)
 	if err != nil {
 		return err
 	}
 
-	s.pulseSink = b.String()
+	s.pulseSink = module
 	return nil
 }
 
@@ -45,10 +38,9 @@ func (s *WebInput) launchXvfb(ctx context.Context, p *params.Params) error {
 	ctx, span := tracer.Start(ctx, "WebInput.launchXvfb")
 	defer span.End()
 
-	dims := fmt.Sprintf("%dx%dx%d", p.Width, p.Height, p.Depth)
-	s.logger.Debugw("launching xvfb", "display", p.Display, "dims", dims)
-	xvfb := exec.Command("Xvfb", p.Display, "-screen", "0", dims, "-ac", "-nolisten", "tcp")
-	if err := xvfb.Start(); err != nil {
+	s.logger.Debugw("launching xvfb", "display", p.Display)
+	xvfb, err := LaunchXvfb(p.Display, p.Width, p.Height, p.Depth)
+	if err != nil {
 		return err
 	}
 
@@ -56,37 +48,42 @@ func (s *WebInput) launchXvfb(ctx context.Context, p *params.Params) error {
 	return nil
 }
 
-// launches chrome and navigates to the url
-func (s *WebInput) launchChrome(ctx context.Context, p *params.Params, insecure bool) error {
-	ctx, span := tracer.Start(ctx, "WebInput.launchChrome")
-	defer span.End()
+// CreatePulseSink loads a null sink with the given name, returning the module index
+func CreatePulseSink(name string) (string, error) {
+	cmd := exec.Command("pactl",
+		"load-module", "module-null-sink",
+		fmt.Sprintf("sink_name=\"%s\"", name),
+		fmt.Sprintf("sink_properties=device.description=\"%s\"", name),
+	)
+	var b bytes.Buffer
+	cmd.Stdout = &b
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
 
-	webUrl := p.WebUrl
-	if webUrl == "" {
-		// create start and end channels
-		s.startRecording = make(chan struct{})
-		s.endRecording = make(chan struct{})
+	return b.String(), nil
+}
 
-		// build input url
-		inputUrl, err := url.Parse(p.TemplateBase)
-		if err != nil {
-			return err
-		}
-		values := inputUrl.Query()
-		values.Set("layout", p.Layout)
-		values.Set("url", p.LKUrl)
-		values.Set("token", p.Token)
-		inputUrl.RawQuery = values.Encode()
-		webUrl = inputUrl.String()
+// LaunchXvfb starts a virtual display
+func LaunchXvfb(display string, width, height, depth int32) (*exec.Cmd, error) {
+	dims := fmt.Sprintf("%dx%dx%d", width, height, depth)
+	xvfb := exec.Command("Xvfb", display, "-screen", "0", dims, "-ac", "-nolisten", "tcp")
+	if err := xvfb.Start(); err != nil {
+		return nil, err
 	}
 
-	s.logger.Debugw("launching chrome", "url", webUrl)
+	return xvfb, nil
+}
 
+// ChromeOptions returns the flags used to run chrome on a display, playing audio to a pulse sink
+func ChromeOptions(display, pulseSink, profileDir string, width, height int32, insecure bool) []chromedp.ExecAllocatorOption {
 	opts := []chromedp.ExecAllocatorOption{
 		chromedp.NoFirstRun,
 		chromedp.NoDefaultBrowserCheck,
 		chromedp.DisableGPU,
 		chromedp.NoSandbox,
+		chromedp.UserDataDir(profileDir),
 
 		// puppeteer default behavior
 		chromedp.Flag("disable-infobars", true),
@@ -118,11 +115,11 @@ func (s *WebInput) launchChrome(ctx context.Context, p *params.Params, insecure
 		chromedp.Flag("enable-automation", false),
 		chromedp.Flag("autoplay-policy", "no-user-gesture-required"),
 		chromedp.Flag("window-position", "0,0"),
-		chromedp.Flag("window-size", fmt.Sprintf("%d,%d", p.Width, p.Height)),
+		chromedp.Flag("window-size", fmt.Sprintf("%d,%d", width, height)),
 
 		// output
-		chromedp.Env(fmt.Sprintf("PULSE_SINK=%s", p.Info.EgressId)),
-		chromedp.Flag("display", p.Display),
+		chromedp.Env(fmt.Sprintf("PULSE_SINK=%s", pulseSink)),
+		chromedp.Flag("display", display),
 	}
 
 	if insecure {
@@ -132,8 +129,53 @@ func (s *WebInput) launchChrome(ctx context.Context, p *params.Params, insecure
 		)
 	}
 
-	allocCtx, _ := chromedp.NewExecAllocator(context.Background(), opts...)
+	return opts
+}
+
+// launches chrome and navigates to the url
+func (s *WebInput) launchChrome(ctx context.Context, p *params.Params, insecure bool) error {
+	ctx, span := tracer.Start(ctx, "WebInput.launchChrome")
+	defer span.End()
+
+	webUrl := p.WebUrl
+	if webUrl == "" {
+		// create start and end channels
+		s.startRecording = make(chan struct{})
+		s.endRecording = make(chan struct{})
+
+		// build input url
+		inputUrl, err := url.Parse(p.TemplateBase)
+		if err != nil {
+			return err
+		}
+		values := inputUrl.Query()
+		values.Set("layout", p.Layout)
+		values.Set("url", p.LKUrl)
+		values.Set("token", p.Token)
+		inputUrl.RawQuery = values.Encode()
+		webUrl = inputUrl.String()
+	}
+
+	var allocCtx context.Context
+	if p.DevToolsUrl != "" {
+		// attach to a pre-launched chrome
+		s.logger.Debugw("connecting to chrome", "url", webUrl, "devtools", p.DevToolsUrl)
+		allocCtx, _ = chromedp.NewRemoteAllocator(context.Background(), p.DevToolsUrl)
+	} else {
+		// each egress gets its own profile, so that concurrent instances do not share state
+		chromeDir, err := os.MkdirTemp("", fmt.Sprintf("chrome-%s-", p.Info.EgressId))
+		if err != nil {
+			return err
+		}
+		s.chromeDir = chromeDir
+
+		s.logger.Debugw("launching chrome", "url", webUrl, "profile", chromeDir)
+		opts := ChromeOptions(p.Display, p.PulseSink, chromeDir, p.Width, p.Height, insecure)
+		allocCtx, _ = chromedp.NewExecAllocator(context.Background(), opts...)
+	}
+
 	chromeCtx, cancel := chromedp.NewContext(allocCtx)
+	s.chromeCtx = chromeCtx
 	s.chromeCancel = cancel
 
 	chromedp.ListenTarget(chromeCtx, func(ev interface{}) {
@@ -189,3 +231,29 @@ func (s *WebInput) launchChrome(ctx context.Context, p *params.Params, insecure
 	}
 	return err
 }
+
+// checks that chrome is still executing javascript
+func (s *WebInput) chromeResponsive(timeout time.Duration) bool {
+	if s.chromeCtx == nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(s.chromeCtx, timeout)
+	defer cancel()
+
+	var res bool
+	return chromedp.Run(ctx, chromedp.Evaluate("true", &res)) == nil && res
+}
+
+// reloads the page, used to recover from a frozen or crashed tab
+func (s *WebInput) reloadChrome(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "WebInput.reloadChrome")
+	defer span.End()
+
+	if s.chromeCtx == nil {
+		return errors.New("chrome not running")
+	}
+
+	s.logger.Infow("reloading chrome")
+	return chromedp.Run(s.chromeCtx, chromedp.Reload())
+}
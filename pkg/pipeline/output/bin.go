@@ -3,8 +3,10 @@ package output
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/tinyzimmer/go-gst/gst"
+	"go.uber.org/atomic"
 
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
@@ -15,6 +17,9 @@ import (
 type OutputBin struct {
 	bin *gst.Bin
 
+	// file
+	fileSink *gst.Element
+
 	// stream
 	protocol params.OutputType
 	tee      *gst.Element
@@ -28,6 +33,9 @@ type streamSink struct {
 	pad   string
 	queue *gst.Element
 	sink  *gst.Element
+
+	// unix nano timestamp of the last buffer pushed to the sink
+	lastBuffer atomic.Int64
 }
 
 func New(ctx context.Context, p *params.Params) (*OutputBin, error) {
@@ -88,6 +96,7 @@ func (o *OutputBin) linkSink(sink *streamSink) error {
 	// intercept FlowFlushing from rtmp2sink
 	proxy.SetChainFunction(func(self *gst.Pad, _ *gst.Object, buffer *gst.Buffer) gst.FlowReturn {
 		buffer.Ref()
+		sink.lastBuffer.Store(time.Now().UnixNano())
 
 		internal, _ := self.GetInternalLinks()
 		if len(internal) != 1 {
@@ -198,6 +207,35 @@ func (o *OutputBin) RemoveSink(url string) error {
 	return nil
 }
 
+// GetFileSinkPad returns the sink pad of the filesink, if any
+func (o *OutputBin) GetFileSinkPad() *gst.Pad {
+	if o.fileSink == nil {
+		return nil
+	}
+	return o.fileSink.GetStaticPad("sink")
+}
+
+// GetStalledSinks returns the urls of stream sinks which have not received a buffer within the timeout.
+// Sinks are not considered stalled until the timeout has passed after since.
+func (o *OutputBin) GetStalledSinks(timeout time.Duration, since time.Time) []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	var stalled []string
+	now := time.Now()
+	for url, sink := range o.sinks {
+		lastBuffer := time.Unix(0, sink.lastBuffer.Load())
+		if lastBuffer.Before(since) {
+			lastBuffer = since
+		}
+		if now.Sub(lastBuffer) > timeout {
+			stalled = append(stalled, url)
+		}
+	}
+
+	return stalled
+}
+
 func (o *OutputBin) GetUrlFromName(name string) (string, error) {
 	for url, sink := range o.sinks {
 		if sink.queue.GetName() == name || sink.sink.GetName() == name {
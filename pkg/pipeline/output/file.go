@@ -33,7 +33,8 @@ func buildFileOutputBin(p *params.Params) (*OutputBin, error) {
 	}
 
 	return &OutputBin{
-		bin:    bin,
-		logger: p.Logger,
+		bin:      bin,
+		fileSink: sink,
+		logger:   p.Logger,
 	}, nil
 }
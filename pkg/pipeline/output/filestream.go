@@ -2,6 +2,7 @@ package output
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
@@ -39,6 +40,7 @@ func buildFileStreamOutputBin(p *params.Params) (*OutputBin, error) {
 
 	b := &OutputBin{
 		bin:      bin,
+		fileSink: filesink,
 		protocol: p.OutputType,
 		tee:      tee,
 		sinks:    make(map[string]*streamSink),
@@ -94,8 +96,10 @@ func buildStreamSinkFS(protocol params.OutputType, url string) (*streamSink, err
 		}
 	}
 
-	return &streamSink{
+	s := &streamSink{
 		queue: queue,
 		sink:  sink,
-	}, nil
+	}
+	s.lastBuffer.Store(time.Now().UnixNano())
+	return s, nil
 }
@@ -2,6 +2,7 @@ package output
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/tinyzimmer/go-gst/gst"
 
@@ -76,8 +77,10 @@ func buildStreamSink(protocol params.OutputType, url string) (*streamSink, error
 		}
 	}
 
-	return &streamSink{
+	s := &streamSink{
 		queue: queue,
 		sink:  sink,
-	}, nil
+	}
+	s.lastBuffer.Store(time.Now().UnixNano())
+	return s, nil
 }
@@ -0,0 +1,71 @@
+package params
+
+import (
+	"encoding/json"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/protocol/auth"
+	"github.com/abdulhaseeb08/protocol/livekit"
+	"github.com/abdulhaseeb08/protocol/logger"
+)
+
+// RequestMetadata is read from the metadata of the request token,
+// ex. {"egress_priority": 10, "egress_constraints": {"region": "us-east"}}
+type RequestMetadata struct {
+	Priority    *int              `json:"egress_priority,omitempty"`
+	Constraints map[string]string `json:"egress_constraints,omitempty"`
+	Tenant      string            `json:"egress_tenant,omitempty"`
+	Storage     string            `json:"egress_storage,omitempty"`
+	Replicas    []string          `json:"egress_replicas,omitempty"`
+
+	// presigned urls by storage filepath or filename, ex. {"egress_upload_urls": {"room.mp4": "https://..."}}
+	UploadURLs    map[string]string `json:"egress_upload_urls,omitempty"`
+	UploadHeaders map[string]string `json:"egress_upload_headers,omitempty"`
+
+	// api key the token was signed with, set when the token is valid
+	APIKey string `json:"-"`
+}
+
+// MatchesLabels checks that every constraint of the request is satisfied by the node labels
+func (m *RequestMetadata) MatchesLabels(labels map[string]string, dedicated bool) bool {
+	if dedicated && len(m.Constraints) == 0 {
+		return false
+	}
+	for k, v := range m.Constraints {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// GetRequestMetadata returns the metadata of a request, which is empty when the token is missing or invalid
+func GetRequestMetadata(conf *config.Config, req *livekit.StartEgressRequest) *RequestMetadata {
+	metadata := &RequestMetadata{}
+	if req.Token == "" {
+		return metadata
+	}
+
+	// tokens can be signed with the node's key, or with the key of a tenant
+	verifier, err := auth.ParseAPIToken(req.Token)
+	if err != nil {
+		return metadata
+	}
+	secret, ok := conf.GetApiSecret(verifier.APIKey())
+	if !ok {
+		return metadata
+	}
+	claims, err := verifier.Verify(secret)
+	if err != nil {
+		return metadata
+	}
+	metadata.APIKey = verifier.APIKey()
+	if claims.Metadata == "" {
+		return metadata
+	}
+
+	if err = json.Unmarshal([]byte(claims.Metadata), metadata); err != nil {
+		logger.Debugw("could not parse request metadata", "egressID", req.EgressId, "error", err)
+	}
+	return metadata
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"os"
 	"path"
 	"strings"
@@ -12,6 +11,7 @@ import (
 
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/stats"
 	"github.com/abdulhaseeb08/protocol/egress"
 	"github.com/abdulhaseeb08/protocol/livekit"
 	"github.com/abdulhaseeb08/protocol/logger"
@@ -19,10 +19,12 @@ import (
 )
 
 type Params struct {
-	conf *config.Config
+	conf     *config.Config
+	metadata *RequestMetadata
 
 	Logger   logger.Logger
 	Info     *livekit.EgressInfo
+	Usage    *stats.ResourceUsage // measured when the egress ends
 	GstReady chan struct{}
 
 	SourceParams
@@ -48,10 +50,12 @@ type SourceParams struct {
 	TemplateBase string
 
 	// web source
-	Display    string
-	Layout     string
-	CustomBase string
-	WebUrl     string
+	Display     string
+	PulseSink   string
+	DevToolsUrl string // set when using a pre-launched chrome
+	Layout      string
+	CustomBase  string
+	WebUrl      string
 
 	// sdk source
 	TrackID             string
@@ -114,7 +118,32 @@ type FileAndStreamParams struct {
 
 type UploadParams struct {
 	UploadConfig    interface{}
+	StorageProfile  string // set when UploadConfig comes from a named storage profile
 	DisableManifest bool
+
+	// file and segment outputs are also uploaded to replicas, and succeed when UploadQuorum destinations succeed
+	Replicas      []*UploadDestination
+	UploadQuorum  int
+	UploadResults []*UploadResult // one for each destination, starting with UploadConfig
+	Encryption    *EncryptionInfo // set once a file has been encrypted
+	Checksums     []*FileChecksum
+}
+
+type UploadDestination struct {
+	UploadConfig   interface{}
+	StorageProfile string
+	Replica        bool
+	Location       config.LocationConfig
+	ObjectOptions  config.ObjectOptionsConfig
+}
+
+// UploadResult records the uploads to a single destination
+type UploadResult struct {
+	Storage  string `json:"storage"`            // storage profile, "default", or "request"
+	Location string `json:"location,omitempty"` // of the file or playlist
+	Uploaded int    `json:"uploaded"`
+	Failed   int    `json:"failed,omitempty"`
+	Error    string `json:"error,omitempty"` // last upload error
 }
 
 func ValidateRequest(ctx context.Context, conf *config.Config, request *livekit.StartEgressRequest) (*livekit.EgressInfo, error) {
@@ -136,8 +165,9 @@ func GetPipelineParams(ctx context.Context, conf *config.Config, request *liveki
 func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest) (p *Params, err error) {
 	// start with defaults
 	p = &Params{
-		conf:   conf,
-		Logger: logger.Logger(logger.GetLogger().WithValues("egressID", request.EgressId)),
+		conf:     conf,
+		metadata: GetRequestMetadata(conf, request),
+		Logger:   logger.Logger(logger.GetLogger().WithValues("egressID", request.EgressId)),
 		Info: &livekit.EgressInfo{
 			EgressId: request.EgressId,
 			RoomId:   request.RoomId,
@@ -169,7 +199,7 @@ func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest)
 
 		// input params
 		p.Layout = req.RoomComposite.Layout
-		p.Display = fmt.Sprintf(":%d", 10+rand.Intn(2147483637))
+		p.PulseSink = request.EgressId
 		if req.RoomComposite.CustomBaseUrl != "" {
 			p.TemplateBase = req.RoomComposite.CustomBaseUrl
 		} else {
@@ -226,7 +256,7 @@ func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest)
 			err = errors.ErrInvalidInput("url")
 			return
 		}
-		p.Display = fmt.Sprintf(":%d", 10+rand.Intn(2147483637))
+		p.PulseSink = request.EgressId
 		p.AudioEnabled = !req.Web.VideoOnly
 		p.VideoEnabled = !req.Web.AudioOnly
 		if !p.AudioEnabled && !p.VideoEnabled {
@@ -522,7 +552,16 @@ func (p *Params) updateFileParams(storageFilepath string, output interface{}) er
 	case *livekit.DirectFileOutput_AliOSS:
 		p.UploadConfig = o.AliOSS
 	default:
-		p.UploadConfig = p.conf.FileUpload
+		upload, filepath, err := p.getStorageProfile(p.StorageFilepath)
+		if err != nil {
+			return err
+		}
+		p.UploadConfig = upload
+		p.StorageFilepath = filepath
+	}
+
+	if err := p.updateReplicas(); err != nil {
+		return err
 	}
 
 	// filename
@@ -594,7 +633,16 @@ func (p *Params) updateSegmentsParams(filePrefix string, playlistFilename string
 	case *livekit.SegmentedFileOutput_AliOSS:
 		p.UploadConfig = o.AliOSS
 	default:
-		p.UploadConfig = p.conf.FileUpload
+		upload, prefix, err := p.getStorageProfile(p.LocalFilePrefix)
+		if err != nil {
+			return err
+		}
+		p.UploadConfig = upload
+		p.LocalFilePrefix = prefix
+	}
+
+	if err := p.updateReplicas(); err != nil {
+		return err
 	}
 
 	// filename
@@ -607,8 +655,8 @@ func (p *Params) updateSegmentsParams(filePrefix string, playlistFilename string
 	return nil
 }
 
-//TODO: have to update this function after changing the protobuf filesss
-//Update: Done
+// TODO: have to update this function after changing the protobuf filesss
+// Update: Done
 func (p *Params) updateFileAndStreamParams(outputType OutputType, urls []string, storageFilepath string, output interface{}) error {
 	p.EgressType = EgressTypeFileAndStream
 	p.StorageFilepathFS = storageFilepath
@@ -630,7 +678,16 @@ func (p *Params) updateFileAndStreamParams(outputType OutputType, urls []string,
 	case *livekit.DirectFileOutput_Gcp:
 		p.UploadConfig = o.Gcp
 	default:
-		p.UploadConfig = p.conf.FileUpload
+		upload, filepath, err := p.getStorageProfile(p.StorageFilepathFS)
+		if err != nil {
+			return err
+		}
+		p.UploadConfig = upload
+		p.StorageFilepathFS = filepath
+	}
+
+	if err := p.updateReplicas(); err != nil {
+		return err
 	}
 
 	// filename
@@ -671,6 +728,98 @@ func (p *Params) updateFileAndStreamParams(outputType OutputType, urls []string,
 	return nil
 }
 
+// getStorageProfile resolves the upload config of a request without its own output location.
+// A named storage profile can be selected with a filepath prefix, ex. "archive:{room_name}.mp4",
+// or with the egress_storage token metadata. Presigned urls can be supplied with the egress_upload_urls
+// token metadata. Otherwise, the default upload config is used
+func (p *Params) getStorageProfile(filepath string) (interface{}, string, error) {
+	if i := strings.Index(filepath, ":"); i > 0 {
+		name := filepath[:i]
+		if upload := p.conf.GetStorage(name); upload != nil {
+			p.StorageProfile = name
+			return upload, filepath[i+1:], nil
+		}
+	}
+
+	if name := p.metadata.Storage; name != "" {
+		upload := p.conf.GetStorage(name)
+		if upload == nil {
+			return nil, filepath, errors.ErrStorageNotFound(name)
+		}
+		p.StorageProfile = name
+		return upload, filepath, nil
+	}
+
+	if len(p.metadata.UploadURLs) > 0 {
+		return &config.HTTPConfig{
+			Method:  "PUT",
+			Headers: p.metadata.UploadHeaders,
+			URLs:    p.metadata.UploadURLs,
+		}, filepath, nil
+	}
+
+	return p.conf.FileUpload, filepath, nil
+}
+
+// updateReplicas adds the configured and requested replicas, and sets the upload quorum
+func (p *Params) updateReplicas() error {
+	primary := "request"
+	if p.StorageProfile != "" {
+		primary = p.StorageProfile
+	} else if p.UploadConfig == p.conf.FileUpload {
+		primary = "default"
+	}
+	p.UploadResults = []*UploadResult{{Storage: primary}}
+
+	names := append(append([]string{}, p.conf.Replication.Storage...), p.metadata.Replicas...)
+	for _, name := range names {
+		if name == primary || p.hasReplica(name) {
+			continue
+		}
+		upload := p.conf.GetStorage(name)
+		if upload == nil {
+			return errors.ErrStorageNotFound(name)
+		}
+		p.Replicas = append(p.Replicas, &UploadDestination{
+			UploadConfig:   upload,
+			StorageProfile: name,
+			Replica:        true,
+			Location:       p.conf.GetLocation(name),
+			ObjectOptions:  p.conf.GetObjectOptions(name),
+		})
+		p.UploadResults = append(p.UploadResults, &UploadResult{Storage: name})
+	}
+
+	p.UploadQuorum = p.conf.Replication.Quorum
+	if p.UploadQuorum <= 0 || p.UploadQuorum > len(p.UploadResults) {
+		p.UploadQuorum = len(p.UploadResults)
+	}
+	return nil
+}
+
+func (p *Params) hasReplica(name string) bool {
+	for _, replica := range p.Replicas {
+		if replica.StorageProfile == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetUploadDestinations returns the primary destination followed by any replicas
+func (p *Params) GetUploadDestinations() []*UploadDestination {
+	primary := &UploadDestination{
+		UploadConfig:   p.UploadConfig,
+		StorageProfile: p.StorageProfile,
+	}
+	// storage from the request has no location config or object options
+	if p.StorageProfile != "" || p.UploadConfig == p.conf.FileUpload {
+		primary.Location = p.conf.GetLocation(p.StorageProfile)
+		primary.ObjectOptions = p.conf.GetObjectOptions(p.StorageProfile)
+	}
+	return append([]*UploadDestination{primary}, p.Replicas...)
+}
+
 func (p *Params) getFilenameInfo() (string, map[string]string) {
 	if p.Info.RoomName != "" {
 		return p.Info.RoomName, map[string]string{
@@ -780,6 +929,10 @@ func (p *Params) updateFilepath(identifier string, replacements map[string]strin
 		p.StorageFilepath = p.StorageFilepath + string(ext)
 	}
 
+	if err := p.checkLocalPath(p.StorageFilepath); err != nil {
+		return err
+	}
+
 	// update filename
 	p.FileInfo.Filename = p.StorageFilepath
 
@@ -829,6 +982,9 @@ func (p *Params) UpdatePrefixAndPlaylist(identifier string, replacements map[str
 
 	var filePrefix string
 	p.StoragePathPrefix, filePrefix = path.Split(p.LocalFilePrefix)
+	if err := p.checkLocalPath(path.Join(p.StoragePathPrefix, p.PlaylistFilename)); err != nil {
+		return err
+	}
 	if p.UploadConfig == nil {
 		if p.StoragePathPrefix != "" {
 			if err := os.MkdirAll(p.StoragePathPrefix, 0755); err != nil {
@@ -853,6 +1009,18 @@ func (p *Params) UpdatePrefixAndPlaylist(identifier string, replacements map[str
 	return nil
 }
 
+// checkLocalPath rejects templated filepaths which would be published outside of a local root
+func (p *Params) checkLocalPath(storageFilepath string) error {
+	for _, d := range p.GetUploadDestinations() {
+		if local, ok := d.UploadConfig.(*config.LocalConfig); ok {
+			if _, err := local.ResolvePath(storageFilepath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (p *Params) UpdatePlaylistNamesFromSDK(replacements map[string]string) {
 	p.LocalFilePrefix = stringReplace(p.LocalFilePrefix, replacements)
 	p.PlaylistFilename = stringReplace(p.PlaylistFilename, replacements)
@@ -923,6 +1091,25 @@ type Manifest struct {
 	AudioTrackID      string `json:"audio_track_id,omitempty"`
 	VideoTrackID      string `json:"video_track_id,omitempty"`
 	SegmentCount      int64  `json:"segment_count,omitempty"`
+
+	Usage      *stats.ResourceUsage `json:"usage,omitempty"`
+	Locations  []*UploadResult      `json:"locations,omitempty"`
+	Encryption *EncryptionInfo      `json:"encryption,omitempty"`
+	Files      []*FileChecksum      `json:"files,omitempty"`
+}
+
+// FileChecksum records the checksums of an uploaded file, segment or playlist, as stored
+type FileChecksum struct {
+	Filename string `json:"filename"` // storage filepath
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	MD5      string `json:"md5"`
+}
+
+// EncryptionInfo records how files and segments were encrypted before upload
+type EncryptionInfo struct {
+	Algorithm string   `json:"algorithm"`
+	KeyIDs    []string `json:"key_ids"` // keys which wrapped the data key of each file
 }
 
 func (p *Params) GetManifest() ([]byte, error) {
@@ -939,6 +1126,10 @@ func (p *Params) GetManifest() ([]byte, error) {
 		TrackSource:       p.TrackSource,
 		AudioTrackID:      p.AudioTrackID,
 		VideoTrackID:      p.VideoTrackID,
+		Usage:             p.Usage,
+		Locations:         p.UploadResults,
+		Encryption:        p.Encryption,
+		Files:             p.Checksums,
 	}
 	if p.SegmentsInfo != nil {
 		manifest.SegmentCount = p.SegmentsInfo.SegmentCount
@@ -12,8 +12,11 @@ import (
 
 	"github.com/tinyzimmer/go-glib/glib"
 	"github.com/tinyzimmer/go-gst/gst"
+	"go.uber.org/atomic"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/encryption"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/input"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/input/sdk"
@@ -21,6 +24,7 @@ import (
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/output"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/sink"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/stats"
 	"github.com/abdulhaseeb08/protocol/livekit"
 	"github.com/abdulhaseeb08/protocol/tracer"
 )
@@ -29,6 +33,8 @@ const (
 	pipelineSource    = "pipeline"
 	eosTimeout        = time.Second * 30
 	maxPendingUploads = 100
+	encryptedSuffix   = ".enc"
+	diskCheckInterval = time.Second * 5
 
 	fragmentOpenedMessage = "splitmuxsink-fragment-opened"
 	fragmentClosedMessage = "splitmuxsink-fragment-closed"
@@ -42,6 +48,8 @@ const (
 type Pipeline struct {
 	*params.Params
 
+	conf *config.Config
+
 	// gstreamer
 	pipeline *gst.Pipeline
 	in       input.Input
@@ -61,8 +69,21 @@ type Pipeline struct {
 	segmentsWg     sync.WaitGroup
 	endedSegments  chan segmentUpdate
 
+	// resource accounting
+	limiter *stats.ResourceLimiter
+
+	// uploads
+	uploadCtx     context.Context
+	cancelUploads context.CancelFunc
+	uploading     atomic.Bool
+	keyProvider   encryption.KeyProvider
+	manifestMu    sync.Mutex
+	checksums     map[string]*params.FileChecksum
+
 	// callbacks
 	onStatusUpdate func(context.Context, *livekit.EgressInfo)
+	onUpload       func(*stats.UploadStats)
+	onStall        func(*stats.StallStats)
 }
 
 type segmentUpdate struct {
@@ -143,13 +164,28 @@ func New(ctx context.Context, conf *config.Config, p *params.Params) (*Pipeline,
 		}
 	}
 
+	var keyProvider encryption.KeyProvider
+	if conf.ClientEncryption != nil {
+		keyProvider, err = encryption.NewKeyProvider(conf.ClientEncryption)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	uploadCtx, cancelUploads := context.WithCancel(context.Background())
+
 	return &Pipeline{
 		Params:         p,
+		conf:           conf,
 		pipeline:       pipeline,
 		in:             in,
 		out:            out,
 		playlistWriter: playlistWriter,
 		closed:         make(chan struct{}),
+		uploadCtx:      uploadCtx,
+		cancelUploads:  cancelUploads,
+		keyProvider:    keyProvider,
+		checksums:      make(map[string]*params.FileChecksum),
 	}, nil
 }
 
@@ -161,6 +197,31 @@ func (p *Pipeline) OnStatusUpdate(f func(context.Context, *livekit.EgressInfo))
 	p.onStatusUpdate = f
 }
 
+// OnUpload is called after each file is uploaded to each destination
+func (p *Pipeline) OnUpload(f func(*stats.UploadStats)) {
+	p.onUpload = f
+}
+
+// OnStall is called each time the watchdog finds a stalled input, encoder or sink
+func (p *Pipeline) OnStall(f func(*stats.StallStats)) {
+	p.onStall = f
+}
+
+// IsUploading returns true once recording has ended and the output is being uploaded
+func (p *Pipeline) IsUploading() bool {
+	return p.uploading.Load()
+}
+
+// CancelUploads stops any uploads in progress. Files which were not uploaded are left for the janitor
+func (p *Pipeline) CancelUploads() {
+	p.cancelUploads()
+}
+
+// SetResourceLimiter is used to record resource usage in the manifest
+func (p *Pipeline) SetResourceLimiter(l *stats.ResourceLimiter) {
+	p.limiter = l
+}
+
 func (p *Pipeline) Run(ctx context.Context) *livekit.EgressInfo {
 	ctx, span := tracer.Start(ctx, "Pipeline.Run")
 	defer span.End()
@@ -206,6 +267,12 @@ func (p *Pipeline) Run(ctx context.Context) *livekit.EgressInfo {
 	// session limit timer
 	p.startSessionLimitTimer(ctx)
 
+	// periodic progress updates
+	p.startProgressUpdates(ctx)
+
+	// stop before the local disk fills up
+	p.startDiskCheck(ctx)
+
 	// add watch
 	p.loop = glib.NewMainLoop(glib.MainContextDefault(), false)
 	p.pipeline.GetPipelineBus().AddWatch(p.messageWatch)
@@ -235,19 +302,37 @@ func (p *Pipeline) Run(ctx context.Context) *livekit.EgressInfo {
 		p.updateDuration(s.GetEndTime())
 	}
 
+	// recorded in the manifest and the final egress info
+	if p.limiter != nil {
+		p.Usage = p.limiter.Usage()
+		p.mu.Lock()
+		stats.SetEgressInfoUsage(p.Info, p.Usage)
+		p.mu.Unlock()
+	}
+
 	// skip upload if there was an error
 	if p.Info.Error != "" {
 		return p.Info
 	}
 
+	p.uploading.Store(true)
+	uploadTimer := time.AfterFunc(p.conf.UploadTimeout.Total, func() {
+		p.Logger.Warnw("upload deadline exceeded", nil)
+		p.CancelUploads()
+	})
+	defer uploadTimer.Stop()
+
 	// upload file
 	switch p.EgressType {
 	case params.EgressTypeFile:
-		var err error
-		p.FileInfo.Location, p.FileInfo.Size, err = p.storeFile(ctx, p.LocalFilepath, p.StorageFilepath, p.OutputType)
+		locations, size, err := p.storeFile(ctx, p.LocalFilepath, p.StorageFilepath, p.OutputType, config.ObjectKindFile)
 		if err != nil {
 			p.Info.Error = err.Error()
 		}
+		location := p.updateLocations(ctx, p.StorageFilepath, locations)
+		p.mu.Lock()
+		p.FileInfo.Location, p.FileInfo.Size = location, size
+		p.mu.Unlock()
 
 		manifestLocalPath := fmt.Sprintf("%s.json", p.LocalFilepath)
 		manifestStoragePath := fmt.Sprintf("%s.json", p.StorageFilepath)
@@ -268,7 +353,14 @@ func (p *Pipeline) Run(ctx context.Context) *livekit.EgressInfo {
 
 			// upload the finalized playlist
 			playlistStoragePath := p.GetStorageFilepath(p.PlaylistFilename)
-			p.SegmentsInfo.PlaylistLocation, _, _ = p.storeFile(ctx, p.PlaylistFilename, playlistStoragePath, p.OutputType)
+			locations, _, err := p.storeFile(ctx, p.PlaylistFilename, playlistStoragePath, p.OutputType, config.ObjectKindPlaylist)
+			if err != nil {
+				p.Info.Error = err.Error()
+			}
+			location := p.updateLocations(ctx, playlistStoragePath, locations)
+			p.mu.Lock()
+			p.SegmentsInfo.PlaylistLocation = location
+			p.mu.Unlock()
 
 			manifestLocalPath := fmt.Sprintf("%s.json", p.PlaylistFilename)
 			manifestStoragePath := fmt.Sprintf("%s.json", playlistStoragePath)
@@ -279,11 +371,14 @@ func (p *Pipeline) Run(ctx context.Context) *livekit.EgressInfo {
 
 	// adding new case here
 	case params.EgressTypeFileAndStream:
-		var err error
-		p.FileInfoFS.Location, p.FileInfoFS.FileSize, err = p.storeFile(ctx, p.LocalFilepath, p.StorageFilepath, p.OutputType)
+		locations, size, err := p.storeFile(ctx, p.LocalFilepath, p.StorageFilepath, p.OutputType, config.ObjectKindFile)
 		if err != nil {
 			p.Info.Error = err.Error()
 		}
+		location := p.updateLocations(ctx, p.StorageFilepath, locations)
+		p.mu.Lock()
+		p.FileInfoFS.Location, p.FileInfoFS.FileSize = location, size
+		p.mu.Unlock()
 
 		manifestLocalPath := fmt.Sprintf("%s.json", p.LocalFilepath)
 		manifestStoragePath := fmt.Sprintf("%s.json", p.StorageFilepath)
@@ -499,17 +594,31 @@ func (p *Pipeline) SendEOS(ctx context.Context) {
 	})
 }
 
+// Abort stops the pipeline immediately, without finalizing or uploading the output
+func (p *Pipeline) Abort(ctx context.Context, reason string) {
+	p.Info.Error = reason
+	p.CancelUploads()
+	p.closeOnce.Do(func() {
+		p.close(ctx)
+	})
+	p.stop()
+}
+
 func (p *Pipeline) close(ctx context.Context) {
 	close(p.closed)
 	if p.limitTimer != nil {
 		p.limitTimer.Stop()
 	}
 
-	if p.Info.Status == livekit.EgressStatus_EGRESS_ACTIVE {
+	p.mu.Lock()
+	ending := p.Info.Status == livekit.EgressStatus_EGRESS_ACTIVE
+	if ending {
 		p.Info.Status = livekit.EgressStatus_EGRESS_ENDING
-		if p.onStatusUpdate != nil {
-			p.onStatusUpdate(ctx, p.Info)
-		}
+	}
+	p.mu.Unlock()
+
+	if ending && p.onStatusUpdate != nil {
+		p.onStatusUpdate(ctx, p.Info)
 	}
 }
 
@@ -517,11 +626,125 @@ func (p *Pipeline) startSessionLimitTimer(ctx context.Context) {
 	if timeout := p.GetSessionTimeout(); timeout > 0 {
 		p.limitTimer = time.AfterFunc(timeout, func() {
 			p.SendEOS(ctx)
-			p.Info.Status = livekit.EgressStatus_EGRESS_LIMIT_REACHED
+			p.setStatus(livekit.EgressStatus_EGRESS_LIMIT_REACHED)
 		})
 	}
 }
 
+func (p *Pipeline) startDiskCheck(ctx context.Context) {
+	var dir string
+	switch p.EgressType {
+	case params.EgressTypeFile, params.EgressTypeFileAndStream:
+		dir = path.Dir(p.LocalFilepath)
+	case params.EgressTypeSegmentedFile:
+		dir = path.Dir(p.PlaylistFilename)
+	default:
+		return
+	}
+
+	minFree := p.conf.Disk.StopFreeMB * 1e6
+	go func() {
+		ticker := time.NewTicker(diskCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.closed:
+				return
+			case <-ticker.C:
+				free, err := stats.GetDiskFree(dir)
+				if err != nil {
+					p.Logger.Warnw("could not read disk usage", err, "path", dir)
+					continue
+				}
+				if free < minFree {
+					p.Logger.Warnw("stopping egress", errors.ErrDiskFull(free), "path", dir)
+					p.SendEOS(ctx)
+					p.setStatus(livekit.EgressStatus_EGRESS_LIMIT_REACHED)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (p *Pipeline) startProgressUpdates(ctx context.Context) {
+	interval := p.conf.ProgressUpdateInterval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.closed:
+				return
+			case <-ticker.C:
+				if p.onStatusUpdate == nil {
+					continue
+				}
+				// only send updates while active, status transitions are sent separately
+				if info := p.updateProgress(time.Now().UnixNano()); info != nil {
+					p.onStatusUpdate(ctx, info)
+				}
+			}
+		}
+	}()
+}
+
+// updateProgress fills in durations and sizes of a running egress, and returns a snapshot of its info.
+// Returns nil if the egress is not active
+func (p *Pipeline) updateProgress(now int64) *livekit.EgressInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Info.Status != livekit.EgressStatus_EGRESS_ACTIVE {
+		return nil
+	}
+
+	switch p.EgressType {
+	case params.EgressTypeStream, params.EgressTypeWebsocket:
+		// StreamInfo has no field for bytes sent, so streams only report their duration
+		for _, info := range p.StreamInfo {
+			if info.Status == livekit.StreamInfo_ACTIVE && info.StartedAt != 0 {
+				info.Duration = now - info.StartedAt
+			}
+		}
+
+	case params.EgressTypeFile:
+		if p.FileInfo.StartedAt != 0 {
+			p.FileInfo.Duration = now - p.FileInfo.StartedAt
+		}
+		if fileInfo, err := os.Stat(p.LocalFilepath); err == nil {
+			p.FileInfo.Size = fileInfo.Size()
+		}
+
+	case params.EgressTypeFileAndStream:
+		if p.FileInfoFS.FileStartedAt != 0 {
+			p.FileInfoFS.FileDuration = now - p.FileInfoFS.FileStartedAt
+		}
+		if fileInfo, err := os.Stat(p.LocalFilepath); err == nil {
+			p.FileInfoFS.FileSize = fileInfo.Size()
+		}
+		for _, info := range p.FileInfoFS.Info {
+			if info.StreamStartedAt != 0 && info.StreamEndedAt == 0 {
+				info.StreamDuration = now - info.StreamStartedAt
+			}
+		}
+
+	case params.EgressTypeSegmentedFile:
+		// size and segment count are updated by the segment worker
+		if p.SegmentsInfo.StartedAt != 0 {
+			p.SegmentsInfo.Duration = now - p.SegmentsInfo.StartedAt
+		}
+	}
+
+	return proto.Clone(p.Info).(*livekit.EgressInfo)
+}
+
 func (p *Pipeline) updateStartTime(startedAt int64) {
 	switch p.EgressType {
 	case params.EgressTypeStream, params.EgressTypeWebsocket:
@@ -535,14 +758,26 @@ func (p *Pipeline) updateStartTime(startedAt int64) {
 	case params.EgressTypeFile:
 		p.FileInfo.StartedAt = startedAt
 
+	case params.EgressTypeFileAndStream:
+		p.FileInfoFS.FileStartedAt = startedAt
+
 	case params.EgressTypeSegmentedFile:
 		p.SegmentsInfo.StartedAt = startedAt
 	}
 
-	p.Info.Status = livekit.EgressStatus_EGRESS_ACTIVE
+	p.setStatus(livekit.EgressStatus_EGRESS_ACTIVE)
 	if p.onStatusUpdate != nil {
 		p.onStatusUpdate(context.Background(), p.Info)
 	}
+
+	// media is flowing, start watching for stalls
+	p.startWatchdog(context.Background())
+}
+
+func (p *Pipeline) setStatus(status livekit.EgressStatus) {
+	p.mu.Lock()
+	p.Info.Status = status
+	p.mu.Unlock()
 }
 
 func (p *Pipeline) startSegmentWorker() {
@@ -553,12 +788,16 @@ func (p *Pipeline) startSegmentWorker() {
 			func() {
 				defer p.segmentsWg.Done()
 
+				p.mu.Lock()
 				p.SegmentsInfo.SegmentCount++
+				p.mu.Unlock()
 
 				segmentStoragePath := p.GetStorageFilepath(update.localPath)
 				// Ignore error. storeFile will log it.
-				_, size, _ := p.storeFile(context.Background(), update.localPath, segmentStoragePath, p.GetSegmentOutputType())
+				_, size, _ := p.storeFile(context.Background(), update.localPath, segmentStoragePath, p.GetSegmentOutputType(), config.ObjectKindSegment)
+				p.mu.Lock()
 				p.SegmentsInfo.Size += size
+				p.mu.Unlock()
 
 				if p.playlistWriter != nil {
 					err := p.playlistWriter.EndSegment(update.localPath, update.endTime)
@@ -567,7 +806,11 @@ func (p *Pipeline) startSegmentWorker() {
 						return
 					}
 					playlistStoragePath := p.GetStorageFilepath(p.PlaylistFilename)
-					p.SegmentsInfo.PlaylistLocation, _, _ = p.storeFile(context.Background(), p.PlaylistFilename, playlistStoragePath, p.OutputType)
+					locations, _, _ := p.storeFile(context.Background(), p.PlaylistFilename, playlistStoragePath, p.OutputType, config.ObjectKindPlaylist)
+					location := p.updateLocations(context.Background(), playlistStoragePath, locations)
+					p.mu.Lock()
+					p.SegmentsInfo.PlaylistLocation = location
+					p.mu.Unlock()
 				}
 			}()
 		}
@@ -641,7 +884,9 @@ func (p *Pipeline) stop() {
 	}
 }
 
-func (p *Pipeline) storeFile(ctx context.Context, localFilepath, storageFilepath string, mime params.OutputType) (destinationUrl string, size int64, err error) {
+// storeFile uploads a file to every destination, returning the location at each destination.
+// An error is returned unless the upload quorum succeeds
+func (p *Pipeline) storeFile(ctx context.Context, localFilepath, storageFilepath string, mime params.OutputType, kind config.ObjectKind) (locations []string, size int64, err error) {
 	ctx, span := tracer.Start(ctx, "Pipeline.storeFile")
 	defer span.End()
 
@@ -652,39 +897,222 @@ func (p *Pipeline) storeFile(ctx context.Context, localFilepath, storageFilepath
 		p.Logger.Errorw("could not read file size", err)
 	}
 
-	var location string
-	switch u := p.UploadConfig.(type) {
-	case *livekit.S3Upload:
-		location = "S3"
-		p.Logger.Debugw("uploading to s3")
-		destinationUrl, err = sink.UploadS3(u, localFilepath, storageFilepath, mime)
+	// recordings and segments never leave the node unencrypted
+	if p.keyProvider != nil && (kind == config.ObjectKindFile || kind == config.ObjectKindSegment) {
+		encryptedFilepath := localFilepath + encryptedSuffix
+		if err = p.encryptFile(localFilepath, encryptedFilepath); err != nil {
+			p.Logger.Errorw("could not encrypt file", err)
+			span.RecordError(err)
+			return nil, size, err
+		}
+		if p.UploadConfig == nil {
+			// local output is replaced by its encrypted copy, which replicas upload in place
+			if err = os.Rename(encryptedFilepath, localFilepath); err != nil {
+				p.Logger.Errorw("could not replace local file", err)
+				span.RecordError(err)
+				return nil, size, err
+			}
+		} else {
+			defer func() {
+				// files which failed to upload are left for the janitor
+				if !sink.HasPendingUploads(encryptedFilepath) {
+					_ = os.Remove(encryptedFilepath)
+				}
+			}()
+			localFilepath = encryptedFilepath
+		}
+		mime = "application/octet-stream"
+	}
+
+	sums, err := sink.ComputeChecksums(localFilepath)
+	if err != nil {
+		p.Logger.Errorw("could not compute checksums", err)
+		span.RecordError(err)
+		return nil, size, err
+	}
+
+	destinations := p.GetUploadDestinations()
+	locations = make([]string, len(destinations))
+	errs := make([]error, len(destinations))
+
+	var wg sync.WaitGroup
+	for i, d := range destinations {
+		wg.Add(1)
+		go func(i int, d *params.UploadDestination) {
+			defer wg.Done()
+			locations[i], errs[i] = p.upload(ctx, d, localFilepath, storageFilepath, mime, kind, sums)
+		}(i, d)
+	}
+	wg.Wait()
+
+	succeeded := 0
+	for i, result := range p.UploadResults {
+		if errs[i] != nil {
+			locations[i] = ""
+			result.Failed++
+			result.Error = errs[i].Error()
+			continue
+		}
+		succeeded++
+		result.Uploaded++
+	}
+	if succeeded > 0 && kind != config.ObjectKindManifest {
+		p.recordChecksums(storageFilepath, sums)
+	}
 
-	case *livekit.GCPUpload:
-		location = "GCP"
-		p.Logger.Debugw("uploading to gcp")
-		destinationUrl, err = sink.UploadGCP(u, localFilepath, storageFilepath)
+	if succeeded < p.UploadQuorum {
+		for _, e := range errs {
+			if e != nil {
+				err = e
+			}
+		}
+		if len(destinations) > 1 {
+			err = errors.ErrUploadQuorum(succeeded, p.UploadQuorum, err)
+		}
+		span.RecordError(err)
+		return locations, size, err
+	}
 
-	case *livekit.AzureBlobUpload:
-		location = "Azure"
-		p.Logger.Debugw("uploading to azure")
-		destinationUrl, err = sink.UploadAzure(u, localFilepath, storageFilepath, mime)
+	return locations, size, nil
+}
 
-	case *livekit.AliOSSUpload:
-		location = "AliOSS"
-		p.Logger.Debugw("uploading to alioss")
-		destinationUrl, err = sink.UploadAliOSS(u, localFilepath, storageFilepath)
+func (p *Pipeline) upload(ctx context.Context, d *params.UploadDestination, localFilepath, storageFilepath string, mime params.OutputType, kind config.ObjectKind, sums *sink.Checksums) (string, error) {
+	ctx, span := tracer.Start(ctx, "Pipeline.upload")
+	defer span.End()
 
-	default:
-		destinationUrl = storageFilepath
+	// only files using configured storage can be retried by the service
+	retryable := d.UploadConfig != nil && (d.StorageProfile != "" || d.UploadConfig == p.conf.FileUpload)
+	if retryable {
+		if err := sink.WritePendingUpload(localFilepath, storageFilepath, mime, kind, d.StorageProfile, d.Replica); err != nil {
+			p.Logger.Warnw("could not write pending upload", err)
+		}
 	}
 
+	uploadCtx, cancel := context.WithTimeout(p.uploadCtx, p.conf.UploadTimeout.Object)
+	defer cancel()
+
+	p.Logger.Debugw("uploading file", "filename", storageFilepath, "storage", d.StorageProfile)
+	start := time.Now()
+	location, destinationUrl, err := sink.Upload(uploadCtx, d.UploadConfig, localFilepath, storageFilepath, mime, d.ObjectOptions.Get(kind), sums)
+	p.recordUpload(span, location, localFilepath, time.Since(start), err)
 	if err != nil {
-		p.Logger.Errorw("could not upload file", err, "location", location)
+		p.Logger.Errorw("could not upload file", err, "location", location, "storage", d.StorageProfile)
 		err = errors.ErrUploadFailed(location, err)
 		span.RecordError(err)
+		return "", err
+	}
+
+	if retryable {
+		if err = sink.RemovePendingUpload(localFilepath, d.StorageProfile, d.Replica); err != nil {
+			p.Logger.Warnw("could not remove pending upload", err)
+		}
+	}
+	return destinationUrl, nil
+}
+
+// attributeSpan is implemented by tracers which support span attributes
+type attributeSpan interface {
+	SetAttribute(key string, value interface{})
+}
+
+func (p *Pipeline) recordUpload(span tracer.Span, provider, localFilepath string, elapsed time.Duration, err error) {
+	if provider == "" {
+		// nothing was uploaded
+		return
+	}
+
+	u := &stats.UploadStats{
+		Provider: provider,
+		Seconds:  elapsed.Seconds(),
+		Failed:   err != nil,
+	}
+	if fileInfo, err := os.Stat(localFilepath); err == nil {
+		u.Bytes = fileInfo.Size()
+	}
+
+	if s, ok := span.(attributeSpan); ok {
+		s.SetAttribute("provider", u.Provider)
+		s.SetAttribute("bytes", u.Bytes)
+		s.SetAttribute("bytes_per_second", u.BytesPerSecond())
+	}
+	if err == nil {
+		p.Logger.Debugw("uploaded file", "provider", provider, "bytes", u.Bytes, "bytesPerSecond", int64(u.BytesPerSecond()))
+	}
+	if p.onUpload != nil {
+		p.onUpload(u)
+	}
+}
+
+// recordChecksums adds an uploaded file to the manifest. The manifest can't include itself
+func (p *Pipeline) recordChecksums(storageFilepath string, sums *sink.Checksums) {
+	p.manifestMu.Lock()
+	defer p.manifestMu.Unlock()
+
+	checksum := p.checksums[storageFilepath]
+	if checksum == nil {
+		// the playlist is uploaded again after each segment
+		checksum = &params.FileChecksum{Filename: storageFilepath}
+		p.checksums[storageFilepath] = checksum
+		p.Checksums = append(p.Checksums, checksum)
+	}
+	checksum.Size = sums.Size
+	checksum.SHA256 = sums.HexSHA256()
+	checksum.MD5 = sums.HexMD5()
+}
+
+// encryptFile encrypts a file with a new data key, and records the id of the key which wrapped it
+func (p *Pipeline) encryptFile(localFilepath, encryptedFilepath string) error {
+	keyID, err := encryption.EncryptFile(p.uploadCtx, p.keyProvider, localFilepath, encryptedFilepath, p.conf.ClientEncryption.ChunkSize)
+	if err != nil {
+		return err
+	}
+
+	p.manifestMu.Lock()
+	defer p.manifestMu.Unlock()
+
+	if p.Encryption == nil {
+		p.Encryption = &params.EncryptionInfo{Algorithm: encryption.Algorithm}
+	}
+	for _, id := range p.Encryption.KeyIDs {
+		if id == keyID {
+			return nil
+		}
+	}
+	p.Encryption.KeyIDs = append(p.Encryption.KeyIDs, keyID)
+	return nil
+}
+
+// updateLocations records the location of the file or playlist at each destination, and returns
+// the download location of the first one
+func (p *Pipeline) updateLocations(ctx context.Context, storageFilepath string, locations []string) string {
+	destinations := p.GetUploadDestinations()
+
+	var primary string
+	for i, location := range locations {
+		if location == "" {
+			continue
+		}
+		p.UploadResults[i].Location = location
+		if primary == "" {
+			primary = p.getDownloadLocation(ctx, destinations[i], storageFilepath, location)
+		}
 	}
+	return primary
+}
 
-	return destinationUrl, size, err
+// getDownloadLocation applies the location config of a destination. Presigned urls take precedence over the cdn
+func (p *Pipeline) getDownloadLocation(ctx context.Context, d *params.UploadDestination, storageFilepath, location string) string {
+	if d.Location.PresignExpiry > 0 {
+		presigned, err := sink.Presign(ctx, d.UploadConfig, storageFilepath, d.Location.PresignExpiry)
+		if err == nil {
+			return presigned
+		}
+		p.Logger.Warnw("could not presign location", err, "storage", d.StorageProfile)
+	}
+	if d.Location.CDNBaseURL != "" {
+		return sink.CDNLocation(d.Location.CDNBaseURL, storageFilepath)
+	}
+	return location
 }
 
 func (p *Pipeline) storeManifest(ctx context.Context, localFilepath, storageFilepath string) error {
@@ -708,32 +1136,40 @@ func (p *Pipeline) storeManifest(ctx context.Context, localFilepath, storageFile
 		return err
 	}
 
-	_, _, err = p.storeFile(ctx, localFilepath, storageFilepath, "application/json")
+	_, _, err = p.storeFile(ctx, localFilepath, storageFilepath, "application/json", config.ObjectKindManifest)
 	return err
 }
 
 func (p *Pipeline) cleanup() {
+	// files which were not uploaded are retried by the janitor
+	if p.IsUploading() && p.uploadCtx.Err() != nil {
+		p.Logger.Infow("uploads canceled, keeping local files")
+		return
+	}
+
 	// clean up temp dir
 	if p.UploadConfig != nil {
+		var dir string
 		switch p.EgressType {
 		case params.EgressTypeFile:
-			dir, _ := path.Split(p.LocalFilepath)
-			if dir != "" {
-				p.Logger.Debugw("removing temporary directory", "path", dir)
-				if err := os.RemoveAll(dir); err != nil {
-					p.Logger.Errorw("could not delete temp dir", err)
-				}
-			}
-
+			dir, _ = path.Split(p.LocalFilepath)
 		case params.EgressTypeSegmentedFile:
-			dir, _ := path.Split(p.PlaylistFilename)
-			if dir != "" {
-				p.Logger.Debugw("removing temporary directory", "path", dir)
-				if err := os.RemoveAll(dir); err != nil {
-					p.Logger.Errorw("could not delete temp dir", err)
-				}
-			}
+			dir, _ = path.Split(p.PlaylistFilename)
 		}
+		if dir != "" {
+			p.removeTempDir(dir)
+		}
+	}
+}
+
+func (p *Pipeline) removeTempDir(dir string) {
+	p.Logger.Debugw("removing temporary directory", "path", dir)
+	kept, err := sink.RemoveTempDir(dir)
+	if err != nil {
+		p.Logger.Errorw("could not delete temp dir", err)
+	} else if kept {
+		// files which failed to upload are retried by the janitor
+		p.Logger.Infow("uploads failed, keeping local files", "path", dir)
 	}
 }
 
@@ -0,0 +1,77 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksums of a file, sent with each upload so that the storage can reject corrupted objects
+type Checksums struct {
+	SHA256 []byte
+	MD5    []byte
+	CRC32C uint32
+	Size   int64
+}
+
+// ComputeChecksums reads a file once, computing all of its checksums
+func ComputeChecksums(localFilepath string) (*Checksums, error) {
+	file, err := os.Open(localFilepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return computeChecksums(file)
+}
+
+func computeChecksums(r io.Reader) (*Checksums, error) {
+	sha := sha256.New()
+	sum := md5.New()
+	crc := crc32.New(crc32cTable)
+
+	size, err := io.Copy(io.MultiWriter(sha, sum, crc), r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checksums{
+		SHA256: sha.Sum(nil),
+		MD5:    sum.Sum(nil),
+		CRC32C: crc.Sum32(),
+		Size:   size,
+	}, nil
+}
+
+func (c *Checksums) HexSHA256() string {
+	return hex.EncodeToString(c.SHA256)
+}
+
+func (c *Checksums) HexMD5() string {
+	return hex.EncodeToString(c.MD5)
+}
+
+func (c *Checksums) Base64SHA256() string {
+	return base64.StdEncoding.EncodeToString(c.SHA256)
+}
+
+func (c *Checksums) Base64MD5() string {
+	return base64.StdEncoding.EncodeToString(c.MD5)
+}
+
+// verify compares the checksums of the stored object with the local file
+func (c *Checksums) verify(stored *Checksums) error {
+	if stored.Size != c.Size || !bytes.Equal(stored.SHA256, c.SHA256) {
+		return errors.ErrChecksumMismatch("sha256", c.HexSHA256(), stored.HexSHA256())
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aliyun/aliyun-oss-go-sdk/oss"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/option"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+// s3Location returns the url of an object, following the custom endpoint and addressing style if set
+func s3Location(conf *livekit.S3Upload, region, storageFilepath string) string {
+	if conf.Endpoint == "" {
+		return objectURL("https", fmt.Sprintf("%s.s3.%s.amazonaws.com", conf.Bucket, region), storageFilepath)
+	}
+
+	u := parseEndpoint(conf.Endpoint)
+	if conf.ForcePathStyle {
+		return objectURL(u.Scheme, u.Host, path.Join(u.Path, conf.Bucket, storageFilepath))
+	}
+	return objectURL(u.Scheme, conf.Bucket+"."+u.Host, path.Join(u.Path, storageFilepath))
+}
+
+func gcpLocation(conf *livekit.GCPUpload, storageFilepath string) string {
+	return objectURL("https", "storage.googleapis.com", path.Join(conf.Bucket, storageFilepath))
+}
+
+func aliOSSLocation(conf *livekit.AliOSSUpload, storageFilepath string) string {
+	u := parseEndpoint(conf.Endpoint)
+	return objectURL(u.Scheme, conf.Bucket+"."+u.Host, storageFilepath)
+}
+
+// parseEndpoint accepts endpoints with or without a scheme, defaulting to https
+func parseEndpoint(endpoint string) *url.URL {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return &url.URL{Scheme: "https", Host: strings.TrimPrefix(endpoint, "https://")}
+	}
+	return u
+}
+
+func objectURL(scheme, host, p string) string {
+	u := &url.URL{
+		Scheme: scheme,
+		Host:   host,
+		Path:   "/" + strings.TrimPrefix(p, "/"),
+	}
+	return u.String()
+}
+
+// CDNLocation returns the url of a file served from a cdn in front of the storage
+func CDNLocation(baseUrl, storageFilepath string) string {
+	return strings.TrimSuffix(baseUrl, "/") + (&url.URL{Path: "/" + strings.TrimPrefix(storageFilepath, "/")}).EscapedPath()
+}
+
+// Presign returns a download url for an uploaded file, valid for the given duration
+func Presign(ctx context.Context, conf interface{}, storageFilepath string, expiry time.Duration) (string, error) {
+	switch u := conf.(type) {
+	case *livekit.S3Upload:
+		return presignS3(u, storageFilepath, expiry)
+	case *livekit.GCPUpload:
+		return presignGCP(ctx, u, storageFilepath, expiry)
+	case *livekit.AzureBlobUpload:
+		return presignAzure(u, storageFilepath, expiry)
+	case *livekit.AliOSSUpload:
+		return presignAliOSS(u, storageFilepath, expiry)
+	default:
+		return "", errors.ErrNotSupported("presigned urls for this storage")
+	}
+}
+
+func presignS3(conf *livekit.S3Upload, storageFilepath string, expiry time.Duration) (string, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials:      credentials.NewStaticCredentials(conf.AccessKey, conf.Secret, ""),
+		Endpoint:         aws.String(conf.Endpoint),
+		Region:           aws.String(conf.Region),
+		S3ForcePathStyle: aws.Bool(conf.ForcePathStyle),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, _ := s3.New(sess).GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(conf.Bucket),
+		Key:    aws.String(storageFilepath),
+	})
+	return req.Presign(expiry)
+}
+
+func presignGCP(ctx context.Context, conf *livekit.GCPUpload, storageFilepath string, expiry time.Duration) (string, error) {
+	var client *storage.Client
+	var err error
+
+	if conf.Credentials != nil {
+		client, err = storage.NewClient(ctx, option.WithCredentialsJSON(conf.Credentials))
+	} else {
+		client, err = storage.NewClient(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	return client.Bucket(conf.Bucket).SignedURL(storageFilepath, &storage.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(expiry),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
+
+func presignAzure(conf *livekit.AzureBlobUpload, storageFilepath string, expiry time.Duration) (string, error) {
+	credential, err := azblob.NewSharedKeyCredential(conf.AccountName, conf.AccountKey)
+	if err != nil {
+		return "", err
+	}
+
+	sas, err := azblob.BlobSASSignatureValues{
+		Protocol:      azblob.SASProtocolHTTPS,
+		ExpiryTime:    time.Now().UTC().Add(expiry),
+		ContainerName: conf.ContainerName,
+		BlobName:      storageFilepath,
+		Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
+	}.NewSASQueryParameters(credential)
+	if err != nil {
+		return "", err
+	}
+
+	blobURL := azblob.NewBlobURLParts(*azureBlobURL(conf, storageFilepath))
+	blobURL.SAS = sas
+	u := blobURL.URL()
+	return u.String(), nil
+}
+
+func presignAliOSS(conf *livekit.AliOSSUpload, storageFilepath string, expiry time.Duration) (string, error) {
+	client, err := oss.New(conf.Endpoint, conf.AccessKey, conf.Secret)
+	if err != nil {
+		return "", err
+	}
+	bucket, err := client.Bucket(conf.Bucket)
+	if err != nil {
+		return "", err
+	}
+
+	return bucket.SignURL(storageFilepath, oss.HTTPGet, int64(expiry.Seconds()))
+}
+
+func azureBlobURL(conf *livekit.AzureBlobUpload, storageFilepath string) *url.URL {
+	return &url.URL{
+		Scheme: "https",
+		Host:   fmt.Sprintf("%s.blob.core.windows.net", conf.AccountName),
+		Path:   path.Join("/", conf.ContainerName, storageFilepath),
+	}
+}
@@ -0,0 +1,93 @@
+package sink
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
+)
+
+// PendingUploadSuffix marks a completed local file which has not been uploaded yet
+const PendingUploadSuffix = ".pending"
+
+type PendingUpload struct {
+	LocalFilepath   string            `json:"-"`
+	StorageFilepath string            `json:"storage_filepath"`
+	MimeType        params.OutputType `json:"mime_type"`
+	ObjectKind      config.ObjectKind `json:"object_kind,omitempty"`
+	StorageProfile  string            `json:"storage_profile,omitempty"` // empty for the default storage
+	Replica         bool              `json:"replica,omitempty"`
+}
+
+// WritePendingUpload records a finished file next to it, so that it can be uploaded again
+// if the handler exits before the upload succeeds
+func WritePendingUpload(localFilepath, storageFilepath string, mime params.OutputType, kind config.ObjectKind, storageProfile string, replica bool) error {
+	b, err := json.Marshal(&PendingUpload{
+		StorageFilepath: storageFilepath,
+		MimeType:        mime,
+		ObjectKind:      kind,
+		StorageProfile:  storageProfile,
+		Replica:         replica,
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(pendingUploadMarker(localFilepath, storageProfile, replica), b, 0644)
+}
+
+func ReadPendingUpload(markerPath string) (*PendingUpload, error) {
+	b, err := os.ReadFile(markerPath)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &PendingUpload{}
+	if err = json.Unmarshal(b, u); err != nil {
+		return nil, err
+	}
+	u.LocalFilepath = strings.TrimSuffix(markerPath, PendingUploadSuffix)
+	if u.Replica {
+		u.LocalFilepath = strings.TrimSuffix(u.LocalFilepath, "."+u.StorageProfile)
+	}
+
+	return u, nil
+}
+
+func RemovePendingUpload(localFilepath, storageProfile string, replica bool) error {
+	err := os.Remove(pendingUploadMarker(localFilepath, storageProfile, replica))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// HasPendingUploads returns true if any destination of the file has not been uploaded yet
+func HasPendingUploads(localFilepath string) bool {
+	if _, err := os.Stat(localFilepath + PendingUploadSuffix); err == nil {
+		return true
+	}
+	markers, _ := filepath.Glob(localFilepath + ".*" + PendingUploadSuffix)
+	return len(markers) > 0
+}
+
+// RemoveTempDir deletes a temporary output directory, unless it holds files which have not been uploaded.
+// Those are left for the janitor to retry
+func RemoveTempDir(dir string) (kept bool, err error) {
+	markers, _ := filepath.Glob(filepath.Join(dir, "*"+PendingUploadSuffix))
+	if len(markers) > 0 {
+		return true, nil
+	}
+	return false, os.RemoveAll(dir)
+}
+
+// each replica has its own marker, ex. "segment_1.ts.archive.pending"
+func pendingUploadMarker(localFilepath, storageProfile string, replica bool) string {
+	if replica {
+		return localFilepath + "." + storageProfile + PendingUploadSuffix
+	}
+	return localFilepath + PendingUploadSuffix
+}
@@ -0,0 +1,48 @@
+package sink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
+)
+
+func TestRemoveTempDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	dir := path.Join(t.TempDir(), "EG_test")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	localFilepath := path.Join(dir, "recording.mp4")
+	require.NoError(t, os.WriteFile(localFilepath, []byte("recording"), 0644))
+	sums, err := ComputeChecksums(localFilepath)
+	require.NoError(t, err)
+
+	// the upload fails without being canceled
+	require.NoError(t, WritePendingUpload(localFilepath, "recording.mp4", params.OutputTypeMP4, config.ObjectKindFile, "", false))
+	conf := &config.HTTPConfig{URL: server.URL + "/{filepath}"}
+	_, err = UploadHTTP(context.Background(), conf, localFilepath, "recording.mp4", params.OutputTypeMP4, nil, sums)
+	require.Error(t, err)
+
+	kept, err := RemoveTempDir(dir)
+	require.NoError(t, err)
+	require.True(t, kept)
+	require.FileExists(t, localFilepath)
+	require.FileExists(t, localFilepath+PendingUploadSuffix)
+
+	// once uploaded, the directory is removed
+	require.NoError(t, RemovePendingUpload(localFilepath, "", false))
+	kept, err = RemoveTempDir(dir)
+	require.NoError(t, err)
+	require.False(t, kept)
+	require.NoDirExists(t, dir)
+}
@@ -0,0 +1,189 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+)
+
+const (
+	sftpTimeout = time.Second * 10
+
+	// partial uploads are kept under this suffix, and resumed by the next attempt
+	sftpPartialSuffix = ".part"
+)
+
+// UploadSFTP sends a file over sftp, resuming any partial upload of the same file
+func UploadSFTP(ctx context.Context, conf *config.SFTPConfig, localFilepath, storageFilepath string, sums *Checksums) (location string, err error) {
+	clientConfig, err := getSSHClientConfig(conf)
+	if err != nil {
+		return "", err
+	}
+
+	dest := path.Join(conf.Directory, storageFilepath)
+
+	delay := minDelay
+	for i := 0; ; i++ {
+		err = putSFTP(ctx, conf, clientConfig, localFilepath, dest, sums)
+		if err == nil || i == maxRetries-1 {
+			break
+		}
+
+		if err = sleepContext(ctx, delay); err != nil {
+			break
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sftp://%s@%s%s", conf.Username, conf.Host, path.Join("/", dest)), nil
+}
+
+func getSSHClientConfig(conf *config.SFTPConfig) (*ssh.ClientConfig, error) {
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(conf.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid sftp host key: %v", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if conf.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(conf.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid sftp private key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if conf.Password != "" {
+		auth = append(auth, ssh.Password(conf.Password))
+	}
+
+	return &ssh.ClientConfig{
+		User:              conf.Username,
+		Auth:              auth,
+		HostKeyCallback:   ssh.FixedHostKey(hostKey),
+		HostKeyAlgorithms: []string{hostKey.Type()},
+		Timeout:           sftpTimeout,
+	}, nil
+}
+
+func putSFTP(ctx context.Context, conf *config.SFTPConfig, clientConfig *ssh.ClientConfig, localFilepath, dest string, sums *Checksums) error {
+	dialer := &net.Dialer{Timeout: sftpTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", conf.Host)
+	if err != nil {
+		return err
+	}
+
+	// closing the connection unblocks any pending request
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = netConn.Close()
+		case <-done:
+		}
+	}()
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, conf.Host, clientConfig)
+	if err != nil {
+		_ = netConn.Close()
+		return err
+	}
+	conn := ssh.NewClient(sshConn, chans, reqs)
+	defer conn.Close()
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if dir := path.Dir(dest); dir != "." {
+		if err = client.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(localFilepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// resume from the end of a previous partial upload
+	partial := dest + sftpPartialSuffix
+	var offset int64
+	if info, err := client.Stat(partial); err == nil && info.Size() <= fileInfo.Size() {
+		offset = info.Size()
+	}
+
+	remote, err := client.OpenFile(partial, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	if err = remote.Truncate(offset); err != nil {
+		_ = remote.Close()
+		return err
+	}
+	if _, err = remote.Seek(offset, io.SeekStart); err != nil {
+		_ = remote.Close()
+		return err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		_ = remote.Close()
+		return err
+	}
+	if _, err = remote.ReadFrom(&contextReader{ctx: ctx, r: file}); err != nil {
+		_ = remote.Close()
+		return err
+	}
+	if err = remote.Close(); err != nil {
+		return err
+	}
+
+	// sftp has no integrity checks, so the upload is read back. A corrupted partial upload is
+	// removed so that the next attempt starts over
+	stored, err := getSFTPChecksums(ctx, client, partial)
+	if err != nil {
+		return err
+	}
+	if err = sums.verify(stored); err != nil {
+		_ = client.Remove(partial)
+		return err
+	}
+
+	// replace any existing file
+	if err = client.PosixRename(partial, dest); err != nil {
+		_ = client.Remove(dest)
+		return client.Rename(partial, dest)
+	}
+	return nil
+}
+
+func getSFTPChecksums(ctx context.Context, client *sftp.Client, remotePath string) (*Checksums, error) {
+	remote, err := client.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+
+	return computeChecksums(&contextReader{ctx: ctx, r: remote})
+}
@@ -0,0 +1,233 @@
+package sink
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+)
+
+const (
+	testUsername = "egress"
+	testPassword = "secret"
+)
+
+func TestUploadSFTP(t *testing.T) {
+	_, hostSigner := newTestKey(t)
+	clientKey, clientSigner := newTestKey(t)
+	addr := startTestSFTPServer(t, hostSigner, clientSigner.PublicKey())
+
+	localFilepath := path.Join(t.TempDir(), "recording.mp4")
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	require.NoError(t, os.WriteFile(localFilepath, content, 0644))
+	sums, err := ComputeChecksums(localFilepath)
+	require.NoError(t, err)
+
+	t.Run("password", func(t *testing.T) {
+		dir := t.TempDir()
+		conf := &config.SFTPConfig{
+			Host:      addr,
+			Username:  testUsername,
+			Password:  testPassword,
+			HostKey:   string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+			Directory: dir,
+		}
+
+		location, err := UploadSFTP(context.Background(), conf, localFilepath, "room/recording.mp4", sums)
+		require.NoError(t, err)
+		require.Equal(t, "sftp://"+testUsername+"@"+addr+path.Join(dir, "room/recording.mp4"), location)
+
+		b, err := os.ReadFile(path.Join(dir, "room/recording.mp4"))
+		require.NoError(t, err)
+		require.Equal(t, content, b)
+	})
+
+	t.Run("private key", func(t *testing.T) {
+		dir := t.TempDir()
+		conf := &config.SFTPConfig{
+			Host:       addr,
+			Username:   testUsername,
+			PrivateKey: clientKey,
+			HostKey:    string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+			Directory:  dir,
+		}
+
+		_, err := UploadSFTP(context.Background(), conf, localFilepath, "recording.mp4", sums)
+		require.NoError(t, err)
+
+		b, err := os.ReadFile(path.Join(dir, "recording.mp4"))
+		require.NoError(t, err)
+		require.Equal(t, content, b)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		dir := t.TempDir()
+		conf := &config.SFTPConfig{
+			Host:      addr,
+			Username:  testUsername,
+			Password:  testPassword,
+			HostKey:   string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+			Directory: dir,
+		}
+
+		// a previous attempt only uploaded part of the file
+		partial := path.Join(dir, "recording.mp4"+sftpPartialSuffix)
+		require.NoError(t, os.WriteFile(partial, content[:10], 0644))
+
+		_, err := UploadSFTP(context.Background(), conf, localFilepath, "recording.mp4", sums)
+		require.NoError(t, err)
+
+		b, err := os.ReadFile(path.Join(dir, "recording.mp4"))
+		require.NoError(t, err)
+		require.Equal(t, content, b)
+		_, err = os.Stat(partial)
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("corrupted resume", func(t *testing.T) {
+		dir := t.TempDir()
+		conf := &config.SFTPConfig{
+			Host:      addr,
+			Username:  testUsername,
+			Password:  testPassword,
+			HostKey:   string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+			Directory: dir,
+		}
+
+		// the partial upload does not match the local file, so the first attempt fails verification
+		partial := path.Join(dir, "recording.mp4"+sftpPartialSuffix)
+		require.NoError(t, os.WriteFile(partial, []byte("corrupted"), 0644))
+
+		_, err := UploadSFTP(context.Background(), conf, localFilepath, "recording.mp4", sums)
+		require.NoError(t, err)
+
+		b, err := os.ReadFile(path.Join(dir, "recording.mp4"))
+		require.NoError(t, err)
+		require.Equal(t, content, b)
+	})
+
+	t.Run("host key mismatch", func(t *testing.T) {
+		_, otherSigner := newTestKey(t)
+		conf := &config.SFTPConfig{
+			Host:      addr,
+			Username:  testUsername,
+			Password:  testPassword,
+			HostKey:   string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey())),
+			Directory: t.TempDir(),
+		}
+
+		clientConfig, err := getSSHClientConfig(conf)
+		require.NoError(t, err)
+		require.Error(t, putSFTP(context.Background(), conf, clientConfig, localFilepath, path.Join(conf.Directory, "recording.mp4"), sums))
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		conf := &config.SFTPConfig{
+			Host:      addr,
+			Username:  testUsername,
+			Password:  "wrong",
+			HostKey:   string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey())),
+			Directory: t.TempDir(),
+		}
+
+		clientConfig, err := getSSHClientConfig(conf)
+		require.NoError(t, err)
+		require.Error(t, putSFTP(context.Background(), conf, clientConfig, localFilepath, path.Join(conf.Directory, "recording.mp4"), sums))
+	})
+}
+
+// newTestKey returns a pem encoded private key and its signer
+func newTestKey(t *testing.T) (string, ssh.Signer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(block)), signer
+}
+
+// startTestSFTPServer serves the local filesystem over sftp, and returns its address
+func startTestSFTPServer(t *testing.T, hostSigner ssh.Signer, clientKey ssh.PublicKey) string {
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == testUsername && string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == testUsername && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSFTP(conn, serverConfig)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveTestSFTP(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(in <-chan *ssh.Request) {
+			for req := range in {
+				_ = req.Reply(req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp", nil)
+			}
+		}(requests)
+
+		go func() {
+			defer channel.Close()
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			_ = server.Serve()
+		}()
+	}
+}
@@ -2,10 +2,18 @@ package sink
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
@@ -19,6 +27,8 @@ import (
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
 	"github.com/abdulhaseeb08/protocol/livekit"
 )
@@ -29,9 +39,7 @@ const (
 	maxDelay   = time.Second * 5
 )
 
-// FIXME Should we use a Context to allow for an overall operation timeout?
-
-func UploadS3(conf *livekit.S3Upload, localFilepath, storageFilepath string, mime params.OutputType) (location string, err error) {
+func UploadS3(ctx context.Context, conf *livekit.S3Upload, localFilepath, storageFilepath string, mime params.OutputType, opts *config.ObjectOptions, sums *Checksums) (location string, err error) {
 	sess, err := session.NewSession(&aws.Config{
 		Credentials:      credentials.NewStaticCredentials(conf.AccessKey, conf.Secret, ""),
 		Endpoint:         aws.String(conf.Endpoint),
@@ -60,6 +68,7 @@ func UploadS3(conf *livekit.S3Upload, localFilepath, storageFilepath string, mim
 		Body:          file,
 		ContentLength: aws.Int64(fileInfo.Size()),
 		ContentType:   aws.String(string(mime)),
+		ContentMD5:    aws.String(sums.Base64MD5()),
 	}
 
 	if len(conf.Metadata) > 0 {
@@ -70,12 +79,54 @@ func UploadS3(conf *livekit.S3Upload, localFilepath, storageFilepath string, mim
 		putObject.Tagging = aws.String(conf.Tagging)
 	}
 
-	_, err = s3.New(sess).PutObject(&putObject)
-	if err != nil {
+	if opts != nil {
+		applyS3Options(&putObject, opts)
+	}
+
+	req, _ := s3.New(sess).PutObjectRequest(&putObject)
+	req.SetContext(ctx)
+	if conf.Endpoint == "" {
+		// not all s3 compatible storage accepts additional checksums
+		req.HTTPRequest.Header.Set("x-amz-checksum-sha256", sums.Base64SHA256())
+	}
+	if err = req.Send(); err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", conf.Bucket, conf.Region, storageFilepath), nil
+	// s3 rejects a content md5 which does not match. Etags are not compared, since they are not always an md5
+	if checksum := req.HTTPResponse.Header.Get("x-amz-checksum-sha256"); checksum != "" && checksum != sums.Base64SHA256() {
+		return "", errors.ErrChecksumMismatch("sha256", sums.Base64SHA256(), checksum)
+	}
+
+	return s3Location(conf, aws.StringValue(sess.Config.Region), storageFilepath), nil
+}
+
+func applyS3Options(putObject *s3.PutObjectInput, opts *config.ObjectOptions) {
+	if opts.StorageClass != "" {
+		putObject.StorageClass = aws.String(opts.StorageClass)
+	}
+	if opts.ACL != "" {
+		putObject.ACL = aws.String(opts.ACL)
+	}
+	if opts.CacheControl != "" {
+		putObject.CacheControl = aws.String(opts.CacheControl)
+	}
+
+	if e := opts.Encryption; e != nil {
+		switch e.Type {
+		case config.EncryptionTypeSSES3:
+			putObject.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+		case config.EncryptionTypeSSEKMS:
+			putObject.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+			if e.KMSKeyID != "" {
+				putObject.SSEKMSKeyId = aws.String(e.KMSKeyID)
+			}
+		case config.EncryptionTypeSSEC:
+			// the sdk encodes the key and adds its md5
+			putObject.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+			putObject.SSECustomerKey = aws.String(string(e.GetCustomerKey()))
+		}
+	}
 }
 
 func convertS3Metadata(metadata map[string]string) map[string]*string {
@@ -87,7 +138,7 @@ func convertS3Metadata(metadata map[string]string) map[string]*string {
 	return result
 }
 
-func UploadAzure(conf *livekit.AzureBlobUpload, localFilepath, storageFilepath string, mime params.OutputType) (location string, err error) {
+func UploadAzure(ctx context.Context, conf *livekit.AzureBlobUpload, localFilepath, storageFilepath string, mime params.OutputType, opts *config.ObjectOptions, sums *Checksums) (location string, err error) {
 	credential, err := azblob.NewSharedKeyCredential(
 		conf.AccountName,
 		conf.AccountKey,
@@ -119,22 +170,94 @@ func UploadAzure(conf *livekit.AzureBlobUpload, localFilepath, storageFilepath s
 	}
 	defer file.Close()
 
-	// upload blocks in parallel for optimal performance
-	// it calls PutBlock/PutBlockList for files larger than 256 MBs and PutBlob for smaller files
-	_, err = azblob.UploadFileToBlockBlob(context.Background(), file, blobURL, azblob.UploadToBlockBlobOptions{
-		BlobHTTPHeaders: azblob.BlobHTTPHeaders{ContentType: string(mime)},
+	uploadOptions := azblob.UploadToBlockBlobOptions{
+		BlobHTTPHeaders: azblob.BlobHTTPHeaders{ContentType: string(mime), ContentMD5: sums.MD5},
 		BlockSize:       4 * 1024 * 1024,
 		Parallelism:     16,
-	})
+	}
+	if opts != nil {
+		applyAzureOptions(&uploadOptions, opts)
+	}
+
+	blockIDs, err := stageAzureBlocks(ctx, file, sums.Size, blobURL, uploadOptions)
 	if err != nil {
 		return "", err
 	}
 
-	return sUrl, nil
+	// the md5 of the whole file is stored for readers
+	_, err = blobURL.CommitBlockList(ctx, blockIDs, uploadOptions.BlobHTTPHeaders, nil, azblob.BlobAccessConditions{},
+		uploadOptions.BlobAccessTier, nil, uploadOptions.ClientProvidedKeyOptions)
+	if err != nil {
+		return "", err
+	}
+
+	return blobURL.String(), nil
+}
+
+// stageAzureBlocks uploads blocks in parallel, each with its md5 so that the service rejects corrupted blocks
+func stageAzureBlocks(ctx context.Context, file *os.File, size int64, blobURL azblob.BlockBlobURL, o azblob.UploadToBlockBlobOptions) ([]string, error) {
+	if size == 0 {
+		return []string{}, nil
+	}
+
+	// block ids are unique to this upload, so that blocks staged by another attempt are never committed
+	prefix := make([]byte, 8)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	blockIDs := make([]string, (size+o.BlockSize-1)/o.BlockSize)
+	err := azblob.DoBatchTransfer(ctx, azblob.BatchTransferOptions{
+		OperationName: "stageAzureBlocks",
+		TransferSize:  size,
+		ChunkSize:     o.BlockSize,
+		Parallelism:   o.Parallelism,
+		Operation: func(offset int64, count int64, ctx context.Context) error {
+			block := io.NewSectionReader(file, offset, count)
+			sum := md5.New()
+			if _, err := io.Copy(sum, block); err != nil {
+				return err
+			}
+			if _, err := block.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			i := offset / o.BlockSize
+			blockIDs[i] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%x-%08d", prefix, i)))
+			_, err := blobURL.StageBlock(ctx, blockIDs[i], block, azblob.LeaseAccessConditions{}, sum.Sum(nil), o.ClientProvidedKeyOptions)
+			return err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blockIDs, nil
+}
+
+// applyAzureOptions sets the access tier, cache control and encryption. Acls are set on the container
+func applyAzureOptions(uploadOptions *azblob.UploadToBlockBlobOptions, opts *config.ObjectOptions) {
+	if opts.StorageClass != "" {
+		uploadOptions.BlobAccessTier = azblob.AccessTierType(opts.StorageClass)
+	}
+	if opts.CacheControl != "" {
+		uploadOptions.BlobHTTPHeaders.CacheControl = opts.CacheControl
+	}
+
+	if e := opts.Encryption; e != nil {
+		switch e.Type {
+		case config.EncryptionTypeSSEKMS:
+			uploadOptions.ClientProvidedKeyOptions = azblob.NewClientProvidedKeyOptions(nil, nil, &e.KMSKeyID)
+		case config.EncryptionTypeSSEC:
+			key := e.GetCustomerKey()
+			sum := sha256.Sum256(key)
+			encodedKey := base64.StdEncoding.EncodeToString(key)
+			encodedSum := base64.StdEncoding.EncodeToString(sum[:])
+			uploadOptions.ClientProvidedKeyOptions = azblob.NewClientProvidedKeyOptions(&encodedKey, &encodedSum, nil)
+		}
+	}
 }
 
-func UploadGCP(conf *livekit.GCPUpload, localFilepath, storageFilepath string) (location string, err error) {
-	ctx := context.Background()
+func UploadGCP(ctx context.Context, conf *livekit.GCPUpload, localFilepath, storageFilepath string, opts *config.ObjectOptions, sums *Checksums) (location string, err error) {
 	var client *storage.Client
 
 	if conf.Credentials != nil {
@@ -170,7 +293,12 @@ func UploadGCP(conf *livekit.GCPUpload, localFilepath, storageFilepath string) (
 		wctx = ctx
 	}
 
-	wc := client.Bucket(conf.Bucket).Object(storageFilepath).Retryer(storage.WithBackoff(gax.Backoff{
+	obj := client.Bucket(conf.Bucket).Object(storageFilepath)
+	if opts != nil && opts.Encryption != nil && opts.Encryption.Type == config.EncryptionTypeSSEC {
+		obj = obj.Key(opts.Encryption.GetCustomerKey())
+	}
+
+	wc := obj.Retryer(storage.WithBackoff(gax.Backoff{
 		Initial:    minDelay,
 		Max:        maxDelay,
 		Multiplier: 2,
@@ -178,6 +306,20 @@ func UploadGCP(conf *livekit.GCPUpload, localFilepath, storageFilepath string) (
 		storage.WithPolicy(storage.RetryAlways),
 	).NewWriter(wctx)
 
+	// the upload fails if either checksum does not match
+	wc.MD5 = sums.MD5
+	wc.CRC32C = sums.CRC32C
+	wc.SendCRC32C = true
+
+	if opts != nil {
+		wc.StorageClass = opts.StorageClass
+		wc.PredefinedACL = opts.ACL
+		wc.CacheControl = opts.CacheControl
+		if opts.Encryption != nil && opts.Encryption.Type == config.EncryptionTypeSSEKMS {
+			wc.KMSKeyName = opts.Encryption.KMSKeyID
+		}
+	}
+
 	if _, err = io.Copy(wc, file); err != nil {
 		return "", err
 	}
@@ -185,11 +327,14 @@ func UploadGCP(conf *livekit.GCPUpload, localFilepath, storageFilepath string) (
 	if err = wc.Close(); err != nil {
 		return "", err
 	}
+	if attrs := wc.Attrs(); attrs.CRC32C != sums.CRC32C {
+		return "", errors.ErrChecksumMismatch("crc32c", fmt.Sprint(sums.CRC32C), fmt.Sprint(attrs.CRC32C))
+	}
 
-	return fmt.Sprintf("https://%s.storage.googleapis.com/%s", conf.Bucket, storageFilepath), nil
+	return gcpLocation(conf, storageFilepath), nil
 }
 
-func UploadAliOSS(conf *livekit.AliOSSUpload, localFilePath, requestedPath string) (location string, err error) {
+func UploadAliOSS(ctx context.Context, conf *livekit.AliOSSUpload, localFilePath, requestedPath string, opts *config.ObjectOptions, sums *Checksums) (location string, err error) {
 	client, err := oss.New(conf.Endpoint, conf.AccessKey, conf.Secret)
 	if err != nil {
 		return "", err
@@ -198,9 +343,307 @@ func UploadAliOSS(conf *livekit.AliOSSUpload, localFilePath, requestedPath strin
 	if err != nil {
 		return "", err
 	}
-	err = bucket.PutObjectFromFile(requestedPath, localFilePath)
+
+	file, err := os.Open(localFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("https://%s.%s/%s", conf.Bucket, conf.Endpoint, requestedPath), nil
+
+	// oss rejects the upload if the md5 does not match, and the sdk checks the crc64 of the stored object
+	options := []oss.Option{oss.ContentLength(fileInfo.Size()), oss.ContentMD5(sums.Base64MD5())}
+	if opts != nil {
+		options = append(options, getAliOSSOptions(opts)...)
+	}
+
+	// the oss sdk does not take a context, so the upload is canceled by failing reads
+	err = bucket.PutObject(requestedPath, &contextReader{ctx: ctx, r: file}, options...)
+	if err != nil {
+		return "", err
+	}
+	return aliOSSLocation(conf, requestedPath), nil
+}
+
+func getAliOSSOptions(opts *config.ObjectOptions) []oss.Option {
+	var options []oss.Option
+	if opts.StorageClass != "" {
+		options = append(options, oss.StorageClass(oss.StorageClassType(opts.StorageClass)))
+	}
+	if opts.ACL != "" {
+		options = append(options, oss.ObjectACL(oss.ACLType(opts.ACL)))
+	}
+	if opts.CacheControl != "" {
+		options = append(options, oss.CacheControl(opts.CacheControl))
+	}
+
+	if e := opts.Encryption; e != nil {
+		switch e.Type {
+		case config.EncryptionTypeSSES3:
+			options = append(options, oss.ServerSideEncryption("AES256"))
+		case config.EncryptionTypeSSEKMS:
+			options = append(options, oss.ServerSideEncryption("KMS"))
+			if e.KMSKeyID != "" {
+				options = append(options, oss.ServerSideEncryptionKeyID(e.KMSKeyID))
+			}
+		case config.EncryptionTypeSSEC:
+			key := e.GetCustomerKey()
+			sum := md5.Sum(key)
+			options = append(options,
+				oss.SSECAlgorithm("AES256"),
+				oss.SSECKey(base64.StdEncoding.EncodeToString(key)),
+				oss.SSECKeyMd5(base64.StdEncoding.EncodeToString(sum[:])),
+			)
+		}
+	}
+	return options
+}
+
+// UploadLocal publishes a file into the local root. It is copied next to its destination, synced,
+// and then renamed, so that readers never see a partial file
+func UploadLocal(ctx context.Context, conf *config.LocalConfig, localFilepath, storageFilepath string, sums *Checksums) (location string, err error) {
+	dest, err := conf.ResolvePath(storageFilepath)
+	if err != nil {
+		return "", err
+	}
+
+	dir, filename := path.Split(dest)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	// the templated path could still leave the root through a symlink
+	realRoot, err := filepath.EvalSymlinks(conf.Root)
+	if err != nil {
+		return "", err
+	}
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	if realDir != realRoot && !strings.HasPrefix(realDir, realRoot+"/") {
+		return "", errors.ErrInvalidInput("filepath")
+	}
+
+	src, err := os.Open(localFilepath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(dir, "."+filename+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = io.Copy(tmp, &contextReader{ctx: ctx, r: src}); err != nil {
+		return "", err
+	}
+	if mode := conf.GetFileMode(); mode != 0 {
+		if err = tmp.Chmod(mode); err != nil {
+			return "", err
+		}
+	}
+	if conf.UID != nil || conf.GID != nil {
+		uid, gid := -1, -1
+		if conf.UID != nil {
+			uid = *conf.UID
+		}
+		if conf.GID != nil {
+			gid = *conf.GID
+		}
+		if err = tmp.Chown(uid, gid); err != nil {
+			return "", err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return "", err
+	}
+
+	// read the copy back before publishing it
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	stored, err := computeChecksums(&contextReader{ctx: ctx, r: tmp})
+	if err != nil {
+		return "", err
+	}
+	if err = sums.verify(stored); err != nil {
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err = os.Rename(tmp.Name(), dest); err != nil {
+		return "", err
+	}
+
+	// sync the directory so that the rename survives a crash
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return dest, nil
+}
+
+// UploadHTTP sends a file as the body of a single request, retrying network and server errors
+func UploadHTTP(ctx context.Context, conf *config.HTTPConfig, localFilepath, storageFilepath string, mime params.OutputType, opts *config.ObjectOptions, sums *Checksums) (location string, err error) {
+	uploadUrl := conf.URLs[storageFilepath]
+	if uploadUrl == "" {
+		_, filename := path.Split(storageFilepath)
+		uploadUrl = conf.URLs[filename]
+	}
+	if uploadUrl == "" {
+		if conf.URL == "" {
+			return "", fmt.Errorf("no upload url for %s", storageFilepath)
+		}
+		uploadUrl = strings.NewReplacer(
+			"{filepath}", (&url.URL{Path: storageFilepath}).EscapedPath(),
+			"{filename}", url.PathEscape(path.Base(storageFilepath)),
+		).Replace(conf.URL)
+	}
+
+	file, err := os.Open(localFilepath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	delay := minDelay
+	for i := 0; ; i++ {
+		var retry bool
+		retry, err = putHTTP(ctx, conf, uploadUrl, file, fileInfo.Size(), mime, opts, sums)
+		if err == nil || !retry || i == maxRetries-1 {
+			break
+		}
+
+		if err = sleepContext(ctx, delay); err != nil {
+			break
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// presigned query parameters should not be shared
+	u, err := url.Parse(uploadUrl)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+func putHTTP(ctx context.Context, conf *config.HTTPConfig, uploadUrl string, file *os.File, size int64, mime params.OutputType, opts *config.ObjectOptions, sums *Checksums) (retry bool, err error) {
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	method := conf.Method
+	if method == "" {
+		method = http.MethodPut
+	}
+	req, err := http.NewRequestWithContext(ctx, method, uploadUrl, io.NopCloser(file))
+	if err != nil {
+		return false, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", string(mime))
+	req.Header.Set("Content-MD5", sums.Base64MD5())
+	req.Header.Set("Digest", "SHA-256="+sums.Base64SHA256())
+	if opts != nil && opts.CacheControl != "" {
+		req.Header.Set("Cache-Control", opts.CacheControl)
+	}
+	for k, v := range conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode >= 300 {
+		retry = res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return false, nil
+}
+
+// Upload sends a file to the storage described by conf, which is one of the livekit upload types, or a local, http or sftp config.
+// The name of the storage provider is returned for logging, along with the uploaded location. opts may be nil.
+// sums are sent with the upload where the storage supports it, and compared with the stored object.
+func Upload(ctx context.Context, conf interface{}, localFilepath, storageFilepath string, mime params.OutputType, opts *config.ObjectOptions, sums *Checksums) (provider, location string, err error) {
+	switch u := conf.(type) {
+	case *livekit.S3Upload:
+		location, err = UploadS3(ctx, u, localFilepath, storageFilepath, mime, opts, sums)
+		return "S3", location, err
+	case *livekit.GCPUpload:
+		location, err = UploadGCP(ctx, u, localFilepath, storageFilepath, opts, sums)
+		return "GCP", location, err
+	case *livekit.AzureBlobUpload:
+		location, err = UploadAzure(ctx, u, localFilepath, storageFilepath, mime, opts, sums)
+		return "Azure", location, err
+	case *livekit.AliOSSUpload:
+		location, err = UploadAliOSS(ctx, u, localFilepath, storageFilepath, opts, sums)
+		return "AliOSS", location, err
+	case *config.LocalConfig:
+		location, err = UploadLocal(ctx, u, localFilepath, storageFilepath, sums)
+		return "Local", location, err
+	case *config.HTTPConfig:
+		location, err = UploadHTTP(ctx, u, localFilepath, storageFilepath, mime, opts, sums)
+		return "HTTP", location, err
+	case *config.SFTPConfig:
+		location, err = UploadSFTP(ctx, u, localFilepath, storageFilepath, sums)
+		return "SFTP", location, err
+	default:
+		return "", storageFilepath, nil
+	}
+}
+
+// contextReader fails reads once its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
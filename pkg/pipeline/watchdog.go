@@ -0,0 +1,246 @@
+package pipeline
+
+import (
+	"context"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+	"go.uber.org/atomic"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/input/builder"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/input/sdk"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/input/web"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/stats"
+	"github.com/abdulhaseeb08/protocol/livekit"
+	"github.com/abdulhaseeb08/protocol/tracer"
+)
+
+const (
+	watchdogInterval      = time.Second
+	chromeResponseTimeout = time.Second * 5
+
+	chromeProbe   = "chrome"
+	fileSinkProbe = "file sink"
+)
+
+type stallAction string
+
+const (
+	stallActionNone         stallAction = "none"
+	stallActionReloadChrome stallAction = "reload_chrome"
+	stallActionRequestPLI   stallAction = "request_pli"
+	stallActionDropSink     stallAction = "drop_sink"
+	stallActionEndEgress    stallAction = "end_egress"
+)
+
+type watchdog struct {
+	timeout       time.Duration
+	maxRecoveries int
+	startedAt     time.Time
+	chromeChecked time.Time
+
+	probes map[string]*flowProbe
+	stalls map[string]int
+}
+
+type flowProbe struct {
+	// unix nano timestamp of the last buffer seen on the pad, reset after each stall is handled
+	lastBuffer atomic.Int64
+	// unix nano timestamp of the last buffer seen on the pad
+	lastSeen atomic.Int64
+}
+
+func (p *Pipeline) startWatchdog(ctx context.Context) {
+	timeout := p.conf.Watchdog.StallTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	now := time.Now()
+	w := &watchdog{
+		timeout:       timeout,
+		maxRecoveries: p.conf.Watchdog.MaxRecoveries,
+		startedAt:     now,
+		chromeChecked: now,
+		probes:        make(map[string]*flowProbe),
+		stalls:        make(map[string]int),
+	}
+
+	pads := p.in.GetFlowPads()
+	if p.out != nil {
+		if pad := p.out.GetFileSinkPad(); pad != nil {
+			pads[fileSinkProbe] = pad
+		}
+	}
+
+	for name, pad := range pads {
+		if pad == nil {
+			continue
+		}
+
+		probe := &flowProbe{}
+		probe.lastBuffer.Store(now.UnixNano())
+		probe.lastSeen.Store(now.UnixNano())
+		pad.AddProbe(gst.PadProbeTypeBuffer|gst.PadProbeTypeBufferList, func(_ *gst.Pad, _ *gst.PadProbeInfo) gst.PadProbeReturn {
+			t := time.Now().UnixNano()
+			probe.lastBuffer.Store(t)
+			probe.lastSeen.Store(t)
+			return gst.PadProbeOK
+		})
+		w.probes[name] = probe
+	}
+
+	go func() {
+		ticker := time.NewTicker(watchdogInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.closed:
+				return
+			case <-ticker.C:
+				p.checkFlow(ctx, w)
+			}
+		}
+	}()
+}
+
+func (p *Pipeline) checkFlow(ctx context.Context, w *watchdog) {
+	now := time.Now()
+
+	// chrome can freeze without affecting the screen capture
+	if s, ok := p.in.(*web.WebInput); ok && now.Sub(w.chromeChecked) >= w.timeout {
+		w.chromeChecked = now
+		if !s.Responsive(chromeResponseTimeout) {
+			p.handleStall(ctx, w, chromeProbe, w.timeout, "")
+		}
+	}
+
+	stalled := make(map[string]time.Duration)
+	for name, probe := range w.probes {
+		if d := now.Sub(time.Unix(0, probe.lastBuffer.Load())); d > w.timeout {
+			stalled[name] = d
+		}
+	}
+
+	for name, d := range stalled {
+		// encoders stop when their source stops, which is handled by the source
+		if name == builder.AudioEncoderPad && stalled[builder.AudioSourcePad] > 0 ||
+			name == builder.VideoEncoderPad && stalled[builder.VideoSourcePad] > 0 {
+			continue
+		}
+
+		p.handleStall(ctx, w, name, d, "")
+
+		// allow the recovery a full timeout before reporting again
+		w.probes[name].lastBuffer.Store(now.UnixNano())
+	}
+
+	if p.out != nil {
+		for _, url := range p.out.GetStalledSinks(w.timeout, w.startedAt) {
+			p.handleStall(ctx, w, url, w.timeout, url)
+		}
+	}
+}
+
+func (p *Pipeline) handleStall(ctx context.Context, w *watchdog, name string, duration time.Duration, url string) {
+	ctx, span := tracer.Start(ctx, "Pipeline.handleStall")
+	defer span.End()
+
+	w.stalls[name]++
+	action := p.getStallAction(w, name, url)
+	if action == stallActionReloadChrome && w.stalls[name] > w.maxRecoveries {
+		action = stallActionEndEgress
+	}
+
+	probe := name
+	if url != "" {
+		// stream urls can hold keys
+		probe = "stream sink"
+	}
+	if p.onStall != nil {
+		p.onStall(&stats.StallStats{Probe: probe, Action: string(action)})
+	}
+
+	err := errors.ErrPipelineStalled(probe, duration)
+	span.RecordError(err)
+	p.Logger.Warnw("pipeline stalled", err,
+		"element", probe,
+		"duration", duration,
+		"stalls", w.stalls[name],
+		"action", action,
+	)
+
+	switch action {
+	case stallActionReloadChrome:
+		if err = p.in.(*web.WebInput).Reload(ctx); err != nil {
+			p.Logger.Errorw("failed to reload chrome", err)
+		}
+
+	case stallActionRequestPLI:
+		p.in.(*sdk.SDKInput).WritePLI()
+
+	case stallActionDropSink:
+		p.mu.Lock()
+		_, ok := p.StreamInfo[url]
+		p.mu.Unlock()
+		if !ok {
+			return
+		}
+
+		if err = p.removeSink(url, livekit.StreamInfo_FAILED); err != nil {
+			// no outputs remaining
+			p.Info.Error = err.Error()
+			p.stop()
+		}
+
+	case stallActionEndEgress:
+		p.SendEOS(ctx)
+	}
+}
+
+func (p *Pipeline) getStallAction(w *watchdog, name, url string) stallAction {
+	if url != "" {
+		return stallActionDropSink
+	}
+
+	switch name {
+	case chromeProbe:
+		return stallActionReloadChrome
+
+	case builder.AudioSourcePad, builder.VideoSourcePad:
+		switch p.in.(type) {
+		case *web.WebInput:
+			return stallActionReloadChrome
+		case *sdk.SDKInput:
+			// tracks can be silent while muted, a key frame request is the only safe recovery
+			if name == builder.VideoSourcePad {
+				return stallActionRequestPLI
+			}
+			return stallActionNone
+		}
+
+	case builder.AudioEncoderPad, builder.VideoEncoderPad:
+		return stallActionEndEgress
+
+	case fileSinkProbe:
+		// the sink stops along with its sources, which can be silent while muted
+		if !w.sourcesFlowing(time.Now()) {
+			return stallActionNone
+		}
+		return stallActionEndEgress
+	}
+
+	return stallActionNone
+}
+
+// sourcesFlowing returns true if every source has produced a buffer within the stall timeout
+func (w *watchdog) sourcesFlowing(now time.Time) bool {
+	for _, name := range []string{builder.AudioSourcePad, builder.VideoSourcePad} {
+		if probe := w.probes[name]; probe != nil && now.Sub(time.Unix(0, probe.lastSeen.Load())) > w.timeout {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+)
+
+const (
+	minDisplay = 10
+	maxDisplay = 10000
+)
+
+// displayAllocator hands out X display numbers which are not used by another egress or X server
+type displayAllocator struct {
+	mu    sync.Mutex
+	inUse map[int]bool
+}
+
+func newDisplayAllocator() *displayAllocator {
+	return &displayAllocator{
+		inUse: make(map[int]bool),
+	}
+}
+
+func (d *displayAllocator) Allocate() (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for n := minDisplay; n < maxDisplay; n++ {
+		if d.inUse[n] || displayExists(n) {
+			continue
+		}
+
+		d.inUse[n] = true
+		return fmt.Sprintf(":%d", n), nil
+	}
+
+	return "", errors.ErrNoDisplayAvailable
+}
+
+func (d *displayAllocator) Release(display string) {
+	var n int
+	if _, err := fmt.Sscanf(display, ":%d", &n); err != nil {
+		return
+	}
+
+	d.mu.Lock()
+	delete(d.inUse, n)
+	d.mu.Unlock()
+}
+
+// displayExists checks for the lock and socket files of a running, or crashed, X server
+func displayExists(n int) bool {
+	for _, f := range []string{
+		fmt.Sprintf("/tmp/.X%d-lock", n),
+		fmt.Sprintf("/tmp/.X11-unix/X%d", n),
+	} {
+		if _, err := os.Stat(f); err == nil {
+			return true
+		}
+	}
+	return false
+}
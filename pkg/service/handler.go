@@ -2,29 +2,45 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"os"
+	"path"
 
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/stats"
 	"github.com/abdulhaseeb08/protocol/egress"
 	"github.com/abdulhaseeb08/protocol/livekit"
 	"github.com/abdulhaseeb08/protocol/logger"
 	"github.com/abdulhaseeb08/protocol/tracer"
 )
 
+// written to the handler's temp path after each update, so the service knows the last status if the handler crashes
+const handlerStatusFile = "status.json"
+
 type Handler struct {
 	conf      *config.Config
 	rpcServer egress.RPCServer
+	tempPath  string
+	webEnv    string
+	ipcSocket string
+	ipc       *ipcClient
+	limiter   *stats.ResourceLimiter
 	kill      chan struct{}
 }
 
-func NewHandler(conf *config.Config, rpcServer egress.RPCServer) *Handler {
+func NewHandler(conf *config.Config, rpcServer egress.RPCServer, tempPath, webEnv, ipcSocket string) *Handler {
 	return &Handler{
 		conf:      conf,
 		rpcServer: rpcServer,
+		tempPath:  tempPath,
+		webEnv:    webEnv,
+		ipcSocket: ipcSocket,
 		kill:      make(chan struct{}),
 	}
 }
@@ -33,11 +49,42 @@ func (h *Handler) HandleRequest(ctx context.Context, req *livekit.StartEgressReq
 	ctx, span := tracer.Start(ctx, "Handler.HandleRequest")
 	defer span.End()
 
+	// report to the service
+	var control <-chan *ipcControl
+	done := make(chan struct{})
+	if h.ipcSocket != "" {
+		ipc, err := dialIPC(h.ipcSocket, req.EgressId)
+		if err != nil {
+			logger.Warnw("failed to connect to service", err, "egressID", req.EgressId)
+		} else {
+			h.ipc = ipc
+			control = ipc.Control()
+
+			defer func() {
+				close(done)
+				ipc.Close()
+			}()
+		}
+	}
+
+	// applies to chrome, xvfb and gstreamer, which are all started by the handler
+	h.limiter = stats.NewResourceLimiter(h.conf.ResourceLimits, req.EgressId, getResourceLimit(h.conf, req))
+	defer func() {
+		h.reportUsage(req.EgressId)
+		h.limiter.Close()
+	}()
+
+	// heartbeats include the warm chrome and xvfb once they are adopted by the limiter
+	if control != nil {
+		h.ipc.StartHeartbeat(done, h.limiter.Metrics)
+	}
+
 	p, err := h.buildPipeline(ctx, req)
 	if err != nil {
 		span.RecordError(err)
 		return
 	}
+	p.SetResourceLimiter(h.limiter)
 
 	// subscribe to request channel
 	requests, err := h.rpcServer.EgressSubscription(context.Background(), p.GetInfo().EgressId)
@@ -53,6 +100,7 @@ func (h *Handler) HandleRequest(ctx context.Context, req *livekit.StartEgressReq
 	}()
 
 	// start egress
+	kill := h.kill
 	result := make(chan *livekit.EgressInfo, 1)
 	go func() {
 		result <- p.Run(ctx)
@@ -60,15 +108,28 @@ func (h *Handler) HandleRequest(ctx context.Context, req *livekit.StartEgressReq
 
 	for {
 		select {
-		case <-h.kill:
-			// kill signal received
-			p.SendEOS(ctx)
+		case <-kill:
+			// kill signal received. Once recording has ended, uploads are canceled instead
+			kill = nil
+			if p.IsUploading() {
+				p.CancelUploads()
+			} else {
+				p.SendEOS(ctx)
+			}
 
 		case res := <-result:
 			// recording finished
 			h.sendUpdate(ctx, res)
 			return
 
+		case ctrl, ok := <-control:
+			// control message from the service
+			if !ok {
+				control = nil
+				continue
+			}
+			h.handleControl(ctx, p, ctrl)
+
 		case msg := <-requests.Channel():
 			// request received
 			request := &livekit.EgressRequest{}
@@ -81,7 +142,9 @@ func (h *Handler) HandleRequest(ctx context.Context, req *livekit.StartEgressReq
 
 			switch r := request.Request.(type) {
 			case *livekit.EgressRequest_UpdateStream:
-				err = p.UpdateStream(ctx, r.UpdateStream)
+				if err = h.checkStreamQuota(req, p, r.UpdateStream); err == nil {
+					err = p.UpdateStream(ctx, r.UpdateStream)
+				}
 			case *livekit.EgressRequest_Stop:
 				p.SendEOS(ctx)
 			default:
@@ -93,6 +156,42 @@ func (h *Handler) HandleRequest(ctx context.Context, req *livekit.StartEgressReq
 	}
 }
 
+// checkStreamQuota returns an error if the update would exceed the stream destinations allowed for the tenant
+func (h *Handler) checkStreamQuota(req *livekit.StartEgressRequest, p *pipeline.Pipeline, update *livekit.UpdateStreamRequest) error {
+	tenant := getTenant(h.conf, req, params.GetRequestMetadata(h.conf, req))
+	if tenant == nil || tenant.MaxStreams <= 0 {
+		return nil
+	}
+
+	active := 0
+	for _, info := range p.GetInfo().GetStream().GetInfo() {
+		if info.Status == livekit.StreamInfo_ACTIVE {
+			active++
+		}
+	}
+
+	if active+len(update.AddOutputUrls)-len(update.RemoveOutputUrls) > tenant.MaxStreams {
+		return errors.ErrQuotaExceeded(tenant.Name, "stream destinations", tenant.MaxStreams)
+	}
+	return nil
+}
+
+func (h *Handler) handleControl(ctx context.Context, p *pipeline.Pipeline, ctrl *ipcControl) {
+	logger.Debugw("handling control message", "egressID", p.GetInfo().EgressId, "type", ctrl.Type)
+
+	switch ctrl.Type {
+	case ipcControlStop:
+		p.SendEOS(ctx)
+	case ipcControlKill:
+		// also cancels uploads
+		p.Abort(ctx, errors.ErrEgressKilled.Error())
+	case ipcControlLogLevel:
+		if err := h.conf.SetLogLevel(ctrl.LogLevel); err != nil {
+			logger.Warnw("invalid log level", err, "level", ctrl.LogLevel)
+		}
+	}
+}
+
 func (h *Handler) buildPipeline(ctx context.Context, req *livekit.StartEgressRequest) (*pipeline.Pipeline, error) {
 	ctx, span := tracer.Start(ctx, "Handler.buildPipeline")
 	defer span.End()
@@ -101,6 +200,9 @@ func (h *Handler) buildPipeline(ctx context.Context, req *livekit.StartEgressReq
 	pipelineParams, err := params.GetPipelineParams(ctx, h.conf, req)
 	var p *pipeline.Pipeline
 
+	if err == nil {
+		err = h.setWebEnv(pipelineParams)
+	}
 	if err == nil {
 		// create the pipeline
 		p, err = pipeline.New(ctx, h.conf, pipelineParams)
@@ -115,9 +217,84 @@ func (h *Handler) buildPipeline(ctx context.Context, req *livekit.StartEgressReq
 	}
 
 	p.OnStatusUpdate(h.sendUpdate)
+	p.OnUpload(func(upload *stats.UploadStats) {
+		if h.ipc != nil {
+			if err := h.ipc.SendUpload(upload); err != nil {
+				logger.Debugw("failed to report upload", "error", err)
+			}
+		}
+	})
+	p.OnStall(func(stall *stats.StallStats) {
+		if h.ipc != nil {
+			if err := h.ipc.SendStall(stall); err != nil {
+				logger.Debugw("failed to report stall", "error", err)
+			}
+		}
+	})
 	return p, nil
 }
 
+// setWebEnv assigns the environment prepared by the service, or a free display when run standalone
+func (h *Handler) setWebEnv(p *params.Params) error {
+	switch p.Info.Request.(type) {
+	case *livekit.EgressInfo_RoomComposite, *livekit.EgressInfo_Web:
+	default:
+		return nil
+	}
+
+	if h.webEnv == "" {
+		display, err := newDisplayAllocator().Allocate()
+		if err != nil {
+			return err
+		}
+		p.Display = display
+		return nil
+	}
+
+	env := &webEnv{}
+	if err := json.Unmarshal([]byte(h.webEnv), env); err != nil {
+		return err
+	}
+
+	h.limiter.Adopt(env.Pids)
+	p.Display = env.Display
+	p.DevToolsUrl = env.DevToolsUrl
+	if env.PulseSink != "" {
+		p.PulseSink = env.PulseSink
+	}
+	return nil
+}
+
+func (h *Handler) reportUsage(egressID string) {
+	usage := h.limiter.Usage()
+	logger.Infow("egress resource usage",
+		"egressID", egressID,
+		"cpuSeconds", usage.CPUSeconds,
+		"peakMemoryBytes", usage.PeakMemoryBytes,
+		"bytesWritten", usage.BytesWritten,
+	)
+
+	if h.ipc != nil {
+		if err := h.ipc.SendUsage(usage); err != nil {
+			logger.Warnw("failed to send usage to service", err)
+		}
+	}
+}
+
+func getResourceLimit(conf *config.Config, req *livekit.StartEgressRequest) config.ResourceLimit {
+	switch req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite:
+		return conf.ResourceLimits.RoomComposite
+	case *livekit.StartEgressRequest_Web:
+		return conf.ResourceLimits.Web
+	case *livekit.StartEgressRequest_TrackComposite:
+		return conf.ResourceLimits.TrackComposite
+	case *livekit.StartEgressRequest_Track:
+		return conf.ResourceLimits.Track
+	}
+	return config.ResourceLimit{}
+}
+
 func (h *Handler) sendUpdate(ctx context.Context, info *livekit.EgressInfo) {
 	requestType, outputType := getTypes(info)
 	switch info.Status {
@@ -145,6 +322,75 @@ func (h *Handler) sendUpdate(ctx context.Context, info *livekit.EgressInfo) {
 	if err := h.rpcServer.SendUpdate(ctx, info); err != nil {
 		logger.Errorw("failed to send update", err)
 	}
+
+	if err := h.writeStatus(info); err != nil {
+		logger.Warnw("failed to write status", err)
+	}
+
+	if h.ipc != nil {
+		if err := h.ipc.SendInfo(info); err != nil {
+			logger.Warnw("failed to send status to service", err)
+		}
+	}
+}
+
+func (h *Handler) writeStatus(info *livekit.EgressInfo) error {
+	if h.tempPath == "" {
+		return nil
+	}
+
+	b, err := protojson.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so that a crash never leaves a partial status
+	statusPath := path.Join(h.tempPath, handlerStatusFile)
+	if err = os.WriteFile(statusPath+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(statusPath+".tmp", statusPath)
+}
+
+// readHandlerStatus returns the last update written by a handler, or nil if it never sent one
+func readHandlerStatus(tempPath string) *livekit.EgressInfo {
+	b, err := os.ReadFile(path.Join(tempPath, handlerStatusFile))
+	if err != nil {
+		return nil
+	}
+
+	info := &livekit.EgressInfo{}
+	if err = protojson.Unmarshal(b, info); err != nil {
+		return nil
+	}
+	return info
+}
+
+// getHandlerStatus returns the most recent update from a handler. The status file is written before each update
+// is sent over ipc, and ipc messages are applied asynchronously, so the file is preferred unless it is behind
+func (s *Service) getHandlerStatus(egressID, tempPath string) *livekit.EgressInfo {
+	fileInfo := readHandlerStatus(tempPath)
+	ipcInfo := s.ipcServer.GetInfo(egressID)
+	if statusRank(ipcInfo) > statusRank(fileInfo) {
+		return ipcInfo
+	}
+	return fileInfo
+}
+
+// statusRank orders updates by how far the egress has progressed
+func statusRank(info *livekit.EgressInfo) int {
+	switch {
+	case info == nil:
+		return 0
+	case isFinalStatus(info.Status):
+		return 4
+	case info.Status == livekit.EgressStatus_EGRESS_ENDING:
+		return 3
+	case info.Status == livekit.EgressStatus_EGRESS_ACTIVE:
+		return 2
+	default:
+		return 1
+	}
 }
 
 func (h *Handler) sendResponse(ctx context.Context, req *livekit.EgressRequest, info *livekit.EgressInfo, err error) {
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+func TestGetHandlerStatus(t *testing.T) {
+	ipcServer, err := newIPCServer("test")
+	require.NoError(t, err)
+	defer ipcServer.Close()
+	s := &Service{ipcServer: ipcServer}
+
+	egressID := "EG_test"
+	info := func(status livekit.EgressStatus) *livekit.EgressInfo {
+		return &livekit.EgressInfo{EgressId: egressID, Status: status}
+	}
+
+	t.Run("handler exits right after sending complete", func(t *testing.T) {
+		h := &Handler{tempPath: t.TempDir()}
+		client, err := dialIPC(ipcServer.socketPath, egressID)
+		require.NoError(t, err)
+		defer ipcServer.Remove(egressID)
+
+		require.NoError(t, h.writeStatus(info(livekit.EgressStatus_EGRESS_ACTIVE)))
+		require.NoError(t, client.SendInfo(info(livekit.EgressStatus_EGRESS_ACTIVE)))
+		require.Eventually(t, func() bool {
+			return ipcServer.GetInfo(egressID) != nil
+		}, time.Second, time.Millisecond*10)
+
+		// the final update reaches the status file, but the ipc message is never applied
+		require.NoError(t, h.writeStatus(info(livekit.EgressStatus_EGRESS_COMPLETE)))
+		client.Close()
+
+		require.Equal(t, livekit.EgressStatus_EGRESS_ACTIVE, ipcServer.GetInfo(egressID).Status)
+		require.Equal(t, livekit.EgressStatus_EGRESS_COMPLETE, s.getHandlerStatus(egressID, h.tempPath).Status)
+	})
+
+	t.Run("status file not written", func(t *testing.T) {
+		client, err := dialIPC(ipcServer.socketPath, egressID)
+		require.NoError(t, err)
+		defer ipcServer.Remove(egressID)
+
+		require.NoError(t, client.SendInfo(info(livekit.EgressStatus_EGRESS_COMPLETE)))
+		require.Eventually(t, func() bool {
+			return ipcServer.GetInfo(egressID) != nil
+		}, time.Second, time.Millisecond*10)
+		client.Close()
+
+		require.Equal(t, livekit.EgressStatus_EGRESS_COMPLETE, s.getHandlerStatus(egressID, t.TempDir()).Status)
+	})
+
+	t.Run("no updates", func(t *testing.T) {
+		require.Nil(t, s.getHandlerStatus(egressID, t.TempDir()))
+	})
+}
@@ -0,0 +1,284 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/tinyzimmer/go-gst/gst"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v3"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+	"github.com/abdulhaseeb08/protocol/egress"
+	"github.com/abdulhaseeb08/protocol/livekit"
+	"github.com/abdulhaseeb08/protocol/logger"
+)
+
+// PooledRequest is sent to an idle handler process, one json object per line on its stdin
+type PooledRequest struct {
+	Request  string `json:"request"`
+	TempPath string `json:"temp_path"`
+}
+
+// pooled handlers write a line to fd 3 each time they finish a request
+const handlerDoneFd = 3
+
+// handlerPool keeps idle handler processes which have already loaded their config and initialized gstreamer
+type handlerPool struct {
+	conf config.HandlerPoolConfig
+	args []string
+
+	mu      sync.Mutex
+	idle    []*pooledHandler
+	pending int
+	closed  bool
+}
+
+type pooledHandler struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	done   chan struct{}
+	exited chan struct{}
+	err    error
+	uses   int
+}
+
+func newHandlerPool(conf *config.Config, ipcSocket string) (*handlerPool, error) {
+	confString, err := yaml.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &handlerPool{
+		conf: conf.HandlerPool,
+		args: []string{
+			"run-handler",
+			"--config-body", string(confString),
+			"--ipc-socket", ipcSocket,
+		},
+	}, nil
+}
+
+// fill spawns handlers until the pool is full
+func (h *handlerPool) fill() {
+	h.mu.Lock()
+	missing := h.conf.Size - len(h.idle) - h.pending
+	if h.closed || missing <= 0 {
+		h.mu.Unlock()
+		return
+	}
+	h.pending += missing
+	h.mu.Unlock()
+
+	for i := 0; i < missing; i++ {
+		ph, err := h.spawn()
+
+		h.mu.Lock()
+		h.pending--
+		if err != nil {
+			logger.Warnw("failed to spawn handler", err)
+		} else if h.closed {
+			_ = ph.stdin.Close()
+		} else {
+			h.idle = append(h.idle, ph)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Claim returns an idle handler for sdk requests, or nil if none are available
+func (h *handlerPool) Claim(req *livekit.StartEgressRequest) *pooledHandler {
+	switch req.Request.(type) {
+	case *livekit.StartEgressRequest_TrackComposite,
+		*livekit.StartEgressRequest_Track:
+	default:
+		return nil
+	}
+
+	h.mu.Lock()
+	var ph *pooledHandler
+	for len(h.idle) > 0 && ph == nil {
+		ph, h.idle = h.idle[0], h.idle[1:]
+		select {
+		case <-ph.exited:
+			ph = nil
+		default:
+		}
+	}
+	h.mu.Unlock()
+
+	go h.fill()
+	return ph
+}
+
+// Run sends a request to a claimed handler and waits for it to finish
+func (h *handlerPool) Run(ph *pooledHandler, req *PooledRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err = ph.stdin.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	select {
+	case <-ph.done:
+		ph.uses++
+		h.release(ph)
+		return nil
+	case <-ph.exited:
+		if ph.err == nil {
+			return errors.ErrHandlerExited(nil)
+		}
+		return ph.err
+	}
+}
+
+// release returns a handler to the pool, or stops it once it has been used enough times
+func (h *handlerPool) release(ph *pooledHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed || ph.uses >= h.conf.MaxUses || len(h.idle) >= h.conf.Size {
+		_ = ph.stdin.Close()
+		return
+	}
+	h.idle = append(h.idle, ph)
+}
+
+func (h *handlerPool) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, ph := range h.idle {
+		_ = ph.stdin.Close()
+	}
+	h.idle = nil
+}
+
+func (h *handlerPool) spawn() (*pooledHandler, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("egress", h.args...)
+	cmd.Dir = "/"
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		_ = r.Close()
+		_ = w.Close()
+		return nil, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		_ = r.Close()
+		_ = w.Close()
+		return nil, err
+	}
+	_ = w.Close()
+
+	ph := &pooledHandler{
+		cmd:    cmd,
+		stdin:  stdin,
+		done:   make(chan struct{}, 1),
+		exited: make(chan struct{}),
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			ph.done <- struct{}{}
+		}
+		_ = r.Close()
+	}()
+
+	go func() {
+		ph.err = cmd.Wait()
+		close(ph.exited)
+	}()
+
+	return ph, nil
+}
+
+// ServePooledRequests runs requests received on stdin until it is closed. Used by pre-spawned handlers
+func ServePooledRequests(ctx context.Context, conf *config.Config, rpcServer egress.RPCServer, ipcSocket string) error {
+	// the whole point of a pooled handler is to pay this once
+	gst.Init(nil)
+
+	done := os.NewFile(handlerDoneFd, "done")
+	defer done.Close()
+
+	var mu sync.Mutex
+	var current *Handler
+	var exiting bool
+
+	killChan := make(chan os.Signal, 1)
+	signal.Notify(killChan, syscall.SIGINT)
+	go func() {
+		sig := <-killChan
+		logger.Infow("exit requested, stopping recording and shutting down", "signal", sig)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if current == nil {
+			os.Exit(0)
+		}
+		exiting = true
+		current.Kill()
+	}()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		pr := &PooledRequest{}
+		if err := json.Unmarshal(scanner.Bytes(), pr); err != nil {
+			return err
+		}
+
+		req := &livekit.StartEgressRequest{}
+		if err := protojson.Unmarshal([]byte(pr.Request), req); err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(pr.TempPath, 0755); err != nil {
+			return err
+		}
+		_ = os.Setenv("TMPDIR", pr.TempPath)
+
+		handler := NewHandler(conf, rpcServer, pr.TempPath, "", ipcSocket)
+		mu.Lock()
+		current = handler
+		mu.Unlock()
+
+		logger.Debugw("pooled handler received request", "egressID", req.EgressId)
+		handler.HandleRequest(ctx, req)
+
+		mu.Lock()
+		current = nil
+		stop := exiting
+		mu.Unlock()
+
+		if _, err := done.Write([]byte("done\n")); err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
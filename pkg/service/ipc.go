@@ -0,0 +1,370 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/stats"
+	"github.com/abdulhaseeb08/protocol/livekit"
+	"github.com/abdulhaseeb08/protocol/logger"
+)
+
+const (
+	ipcHeartbeatInterval = time.Second * 5
+	ipcHealthTimeout     = ipcHeartbeatInterval * 3
+
+	ipcControlStop     = "stop"
+	ipcControlKill     = "kill"
+	ipcControlLogLevel = "log_level"
+)
+
+// ipcMessage is sent from a handler to the service, one json object per line
+type ipcMessage struct {
+	EgressID string                `json:"egress_id"`
+	Info     json.RawMessage       `json:"info,omitempty"`
+	Metrics  *stats.HandlerMetrics `json:"metrics,omitempty"`
+	Usage    *stats.ResourceUsage  `json:"usage,omitempty"`
+	Upload   *stats.UploadStats    `json:"upload,omitempty"`
+	Stall    *stats.StallStats     `json:"stall,omitempty"`
+}
+
+// ipcControl is sent from the service to a handler
+type ipcControl struct {
+	Type     string `json:"type"`
+	LogLevel string `json:"log_level,omitempty"`
+}
+
+// ipcServer accepts connections from handlers, keeping the last info and metrics sent by each
+type ipcServer struct {
+	socketPath string
+	listener   net.Listener
+	handlers   sync.Map // egressID -> *handlerConn
+	onMetrics  func(egressID string, metrics *stats.HandlerMetrics)
+	onUpload   func(upload *stats.UploadStats)
+	onStall    func(stall *stats.StallStats)
+}
+
+type handlerConn struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	info     *livekit.EgressInfo
+	metrics  *stats.HandlerMetrics
+	usage    *stats.ResourceUsage
+	lastSeen time.Time
+}
+
+// HandlerStatus is the service's view of a running handler
+type HandlerStatus struct {
+	Info     json.RawMessage       `json:"info,omitempty"`
+	Metrics  *stats.HandlerMetrics `json:"metrics,omitempty"`
+	Usage    *stats.ResourceUsage  `json:"usage,omitempty"`
+	LastSeen time.Time             `json:"last_seen"`
+	Healthy  bool                  `json:"healthy"`
+}
+
+// newIPCServer listens on a socket in a new private directory, since handlers can be controlled through it
+func newIPCServer(nodeID string) (*ipcServer, error) {
+	dir, err := os.MkdirTemp("", fmt.Sprintf("egress-%s-", nodeID))
+	if err != nil {
+		return nil, err
+	}
+
+	socketPath := path.Join(dir, "ipc.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	if err = os.Chmod(socketPath, 0600); err != nil {
+		_ = listener.Close()
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &ipcServer{
+		socketPath: socketPath,
+		listener:   listener,
+	}
+	go s.accept()
+	return s, nil
+}
+
+func (s *ipcServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ipcServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var egressID string
+	var h *handlerConn
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		msg := &ipcMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), msg); err != nil {
+			logger.Warnw("malformed ipc message", err)
+			continue
+		}
+
+		if h == nil {
+			// handlers register with their first message. Later messages are dropped once the egress
+			// has been removed, so that a late heartbeat can't bring back an ended handler
+			egressID = msg.EgressID
+			h = &handlerConn{conn: conn}
+			s.handlers.Store(egressID, h)
+		} else if v, ok := s.handlers.Load(egressID); !ok || v != h {
+			continue
+		}
+
+		h.mu.Lock()
+		h.lastSeen = time.Now()
+		if msg.Info != nil {
+			info := &livekit.EgressInfo{}
+			if err := protojson.Unmarshal(msg.Info, info); err == nil {
+				h.info = info
+			}
+		}
+		if msg.Metrics != nil {
+			h.metrics = msg.Metrics
+			if s.onMetrics != nil {
+				s.onMetrics(egressID, msg.Metrics)
+			}
+		}
+		if msg.Usage != nil {
+			h.usage = msg.Usage
+		}
+		if msg.Upload != nil && s.onUpload != nil {
+			s.onUpload(msg.Upload)
+		}
+		if msg.Stall != nil && s.onStall != nil {
+			s.onStall(msg.Stall)
+		}
+		h.mu.Unlock()
+	}
+
+	if h != nil {
+		h.mu.Lock()
+		h.conn = nil
+		h.mu.Unlock()
+	}
+}
+
+// OnMetrics sets a callback for metrics received from handlers. Must be set before handlers connect
+func (s *ipcServer) OnMetrics(f func(egressID string, metrics *stats.HandlerMetrics)) {
+	s.onMetrics = f
+}
+
+// OnUpload sets a callback for uploads reported by handlers. Must be set before handlers connect
+func (s *ipcServer) OnUpload(f func(upload *stats.UploadStats)) {
+	s.onUpload = f
+}
+
+// OnStall sets a callback for stalls reported by handlers. Must be set before handlers connect
+func (s *ipcServer) OnStall(f func(stall *stats.StallStats)) {
+	s.onStall = f
+}
+
+// GetInfo returns the last EgressInfo reported by the handler
+func (s *ipcServer) GetInfo(egressID string) *livekit.EgressInfo {
+	v, ok := s.handlers.Load(egressID)
+	if !ok {
+		return nil
+	}
+
+	h := v.(*handlerConn)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.info
+}
+
+func (s *ipcServer) GetStatus(egressID string) *HandlerStatus {
+	v, ok := s.handlers.Load(egressID)
+	if !ok {
+		return nil
+	}
+
+	h := v.(*handlerConn)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := &HandlerStatus{
+		Metrics:  h.metrics,
+		Usage:    h.usage,
+		LastSeen: h.lastSeen,
+		Healthy:  h.conn != nil && time.Since(h.lastSeen) < ipcHealthTimeout,
+	}
+	if h.info != nil {
+		status.Info, _ = protojson.Marshal(h.info)
+	}
+	return status
+}
+
+// SendControl sends a control message to the handler running the egress
+func (s *ipcServer) SendControl(egressID string, ctrl *ipcControl) bool {
+	v, ok := s.handlers.Load(egressID)
+	if !ok {
+		return false
+	}
+
+	b, err := json.Marshal(ctrl)
+	if err != nil {
+		return false
+	}
+
+	h := v.(*handlerConn)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn == nil {
+		return false
+	}
+	_, err = h.conn.Write(append(b, '\n'))
+	return err == nil
+}
+
+func (s *ipcServer) Remove(egressID string) {
+	s.handlers.Delete(egressID)
+}
+
+func (s *ipcServer) Close() {
+	_ = s.listener.Close()
+	_ = os.RemoveAll(path.Dir(s.socketPath))
+}
+
+// ipcClient is used by a handler to report to the service
+type ipcClient struct {
+	egressID string
+	control  chan *ipcControl
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func dialIPC(socketPath, egressID string) (*ipcClient, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ipcClient{
+		egressID: egressID,
+		control:  make(chan *ipcControl, 8),
+		conn:     conn,
+	}
+	go c.read()
+	return c, nil
+}
+
+func (c *ipcClient) read() {
+	defer close(c.control)
+
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		ctrl := &ipcControl{}
+		if err := json.Unmarshal(scanner.Bytes(), ctrl); err != nil {
+			logger.Warnw("malformed ipc control message", err)
+			continue
+		}
+		select {
+		case c.control <- ctrl:
+		default:
+			logger.Warnw("dropping ipc control message", nil, "type", ctrl.Type)
+		}
+	}
+}
+
+// Control returns control messages sent by the service
+func (c *ipcClient) Control() <-chan *ipcControl {
+	return c.control
+}
+
+func (c *ipcClient) SendInfo(info *livekit.EgressInfo) error {
+	b, err := protojson.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return c.send(&ipcMessage{Info: b})
+}
+
+// SendUsage reports the resources used by the egress once it has ended
+func (c *ipcClient) SendUsage(usage *stats.ResourceUsage) error {
+	return c.send(&ipcMessage{Usage: usage})
+}
+
+func (c *ipcClient) SendUpload(upload *stats.UploadStats) error {
+	return c.send(&ipcMessage{Upload: upload})
+}
+
+func (c *ipcClient) SendStall(stall *stats.StallStats) error {
+	return c.send(&ipcMessage{Stall: stall})
+}
+
+// StartHeartbeat sends process metrics until done is closed
+func (c *ipcClient) StartHeartbeat(done <-chan struct{}, metrics func() *stats.HandlerMetrics) {
+	go func() {
+		ticker := time.NewTicker(ipcHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := c.send(&ipcMessage{Metrics: metrics()}); err != nil {
+				logger.Debugw("failed to send heartbeat", "error", err)
+			}
+
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (c *ipcClient) send(msg *ipcMessage) error {
+	msg.EgressID = c.egressID
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.conn.Write(append(b, '\n'))
+	return err
+}
+
+func (c *ipcClient) Close() {
+	_ = c.conn.Close()
+}
+
+// GetMetrics returns the latest metrics of each connected handler, and the number of unhealthy handlers
+func (s *ipcServer) GetMetrics() ([]*stats.HandlerMetrics, int) {
+	var metrics []*stats.HandlerMetrics
+	unhealthy := 0
+	s.handlers.Range(func(_, value interface{}) bool {
+		h := value.(*handlerConn)
+		h.mu.Lock()
+		if h.metrics != nil {
+			metrics = append(metrics, h.metrics)
+		}
+		if h.conn == nil || time.Since(h.lastSeen) >= ipcHealthTimeout {
+			unhealthy++
+		}
+		h.mu.Unlock()
+		return true
+	})
+	return metrics, unhealthy
+}
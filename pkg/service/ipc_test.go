@@ -0,0 +1,58 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/stats"
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+func TestIPCRemove(t *testing.T) {
+	ipcServer, err := newIPCServer("test")
+	require.NoError(t, err)
+	defer ipcServer.Close()
+
+	egressID := "EG_test"
+	info := &livekit.EgressInfo{EgressId: egressID, Status: livekit.EgressStatus_EGRESS_ACTIVE}
+
+	client, err := dialIPC(ipcServer.socketPath, egressID)
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.SendInfo(info))
+	require.Eventually(t, func() bool {
+		return ipcServer.GetStatus(egressID) != nil
+	}, time.Second, time.Millisecond*10)
+
+	// messages sent after the egress has been removed are dropped
+	ipcServer.Remove(egressID)
+	require.NoError(t, client.send(&ipcMessage{Metrics: &stats.HandlerMetrics{}}))
+	require.NoError(t, client.SendUsage(&stats.ResourceUsage{}))
+	require.Never(t, func() bool {
+		return ipcServer.GetStatus(egressID) != nil
+	}, time.Millisecond*200, time.Millisecond*10)
+
+	metrics, unhealthy := ipcServer.GetMetrics()
+	require.Empty(t, metrics)
+	require.Zero(t, unhealthy)
+
+	// a relaunched handler registers again
+	relaunched, err := dialIPC(ipcServer.socketPath, egressID)
+	require.NoError(t, err)
+	defer relaunched.Close()
+
+	require.NoError(t, relaunched.SendInfo(info))
+	require.Eventually(t, func() bool {
+		status := ipcServer.GetStatus(egressID)
+		return status != nil && status.Healthy
+	}, time.Second, time.Millisecond*10)
+
+	// the previous handler can't update it
+	require.NoError(t, client.SendUsage(&stats.ResourceUsage{CPUSeconds: 1}))
+	require.Never(t, func() bool {
+		return ipcServer.GetStatus(egressID).Usage != nil
+	}, time.Millisecond*200, time.Millisecond*10)
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/sink"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/stats"
+	"github.com/abdulhaseeb08/protocol/logger"
+	"github.com/abdulhaseeb08/protocol/utils"
+)
+
+// requests create their directories during validation, before the handler is launched
+const orphanGracePeriod = time.Minute
+
+func (s *Service) startJanitor() {
+	go func() {
+		s.cleanOrphans()
+
+		ticker := time.NewTicker(s.conf.Janitor.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.shutdown:
+				return
+			case <-ticker.C:
+				s.cleanOrphans()
+			}
+		}
+	}()
+}
+
+// cleanOrphans looks for egress directories which no longer belong to a running handler
+func (s *Service) cleanOrphans() {
+	dirs := []string{s.conf.LocalOutputDirectory}
+	if tempDir := path.Clean(os.TempDir()); tempDir != s.conf.LocalOutputDirectory {
+		dirs = append(dirs, tempDir)
+	}
+
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			logger.Warnw("could not read directory", err, "path", dir)
+			continue
+		}
+
+		for _, entry := range entries {
+			egressID := entry.Name()
+			if !entry.IsDir() || !strings.HasPrefix(egressID, utils.EgressPrefix) {
+				continue
+			}
+			if _, running := s.processes.Load(egressID); running {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < orphanGracePeriod {
+				continue
+			}
+
+			s.cleanOrphan(path.Join(dir, egressID), egressID)
+		}
+	}
+}
+
+func (s *Service) cleanOrphan(dir, egressID string) {
+	// retry uploads of completed files first
+	markers, _ := filepath.Glob(path.Join(dir, "*"+sink.PendingUploadSuffix))
+	for _, marker := range markers {
+		s.retryUpload(marker, egressID)
+	}
+
+	// delete anything past its retention
+	var dirs []string
+	_ = filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			dirs = append(dirs, name)
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < s.conf.Janitor.Retention {
+			return nil
+		}
+
+		if err = os.Remove(name); err != nil {
+			logger.Warnw("could not delete orphaned file", err, "path", name, "egressID", egressID)
+			return nil
+		}
+		logger.Infow("deleted orphaned file", "path", name, "size", info.Size(), "egressID", egressID)
+		s.monitor.FileReclaimed("deleted", info.Size())
+		return nil
+	})
+
+	// remove directories once empty, deepest first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		_ = os.Remove(dirs[i])
+	}
+}
+
+func (s *Service) retryUpload(marker, egressID string) {
+	u, err := sink.ReadPendingUpload(marker)
+	if err != nil {
+		logger.Warnw("could not read pending upload", err, "path", marker, "egressID", egressID)
+		return
+	}
+
+	upload := s.conf.FileUpload
+	if u.StorageProfile != "" {
+		upload = s.conf.GetStorage(u.StorageProfile)
+	}
+	if upload == nil {
+		// storage is no longer configured, leave the file for retention to delete
+		return
+	}
+
+	objectOptions := s.conf.GetObjectOptions(u.StorageProfile)
+
+	fileInfo, err := os.Stat(u.LocalFilepath)
+	if err != nil {
+		// file is gone, nothing left to upload
+		_ = os.Remove(marker)
+		return
+	}
+
+	sums, err := sink.ComputeChecksums(u.LocalFilepath)
+	if err != nil {
+		logger.Warnw("could not compute checksums", err, "path", u.LocalFilepath, "egressID", egressID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.conf.UploadTimeout.Object)
+	defer cancel()
+
+	start := time.Now()
+	provider, location, err := sink.Upload(ctx, upload, u.LocalFilepath, u.StorageFilepath, u.MimeType, objectOptions.Get(u.ObjectKind), sums)
+	s.monitor.RecordUpload(&stats.UploadStats{
+		Provider: provider,
+		Bytes:    fileInfo.Size(),
+		Seconds:  time.Since(start).Seconds(),
+		Failed:   err != nil,
+	})
+	if err != nil {
+		logger.Warnw("could not upload orphaned file", err,
+			"path", u.LocalFilepath,
+			"location", provider,
+			"egressID", egressID,
+		)
+		return
+	}
+
+	logger.Infow("uploaded orphaned file",
+		"path", u.LocalFilepath,
+		"location", location,
+		"size", fileInfo.Size(),
+		"egressID", egressID,
+	)
+	s.monitor.FileReclaimed("uploaded", fileInfo.Size())
+
+	_ = os.Remove(marker)
+	if !sink.HasPendingUploads(u.LocalFilepath) {
+		_ = os.Remove(u.LocalFilepath)
+	}
+}
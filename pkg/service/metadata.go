@@ -0,0 +1,51 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+// getTenant returns the first tenant matching the request, or nil
+func getTenant(conf *config.Config, req *livekit.StartEgressRequest, metadata *params.RequestMetadata) *config.TenantConfig {
+	roomName := getRoomName(req)
+	for _, tenant := range conf.Tenants {
+		switch {
+		case metadata.Tenant != "" && metadata.Tenant == tenant.Name,
+			tenant.ApiKey != "" && metadata.APIKey == tenant.ApiKey,
+			tenant.RoomPrefix != "" && roomName != "" && strings.HasPrefix(roomName, tenant.RoomPrefix):
+			return tenant
+		}
+	}
+	return nil
+}
+
+func getRoomName(req *livekit.StartEgressRequest) string {
+	switch r := req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite:
+		return r.RoomComposite.RoomName
+	case *livekit.StartEgressRequest_TrackComposite:
+		return r.TrackComposite.RoomName
+	case *livekit.StartEgressRequest_Track:
+		return r.Track.RoomName
+	}
+	return ""
+}
+
+// getStreamCount returns the number of stream destinations in a request
+func getStreamCount(req *livekit.StartEgressRequest) int {
+	switch r := req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite:
+		return len(r.RoomComposite.GetStream().GetUrls())
+	case *livekit.StartEgressRequest_Web:
+		return len(r.Web.GetStream().GetUrls())
+	case *livekit.StartEgressRequest_TrackComposite:
+		if fs := r.TrackComposite.GetFileAndStream(); fs != nil {
+			return len(fs.Urls)
+		}
+		return len(r.TrackComposite.GetStream().GetUrls())
+	}
+	return 0
+}
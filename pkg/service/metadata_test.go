@@ -0,0 +1,64 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
+	"github.com/abdulhaseeb08/protocol/auth"
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+func TestGetTenant(t *testing.T) {
+	conf := &config.Config{
+		ApiKey:    "node_key",
+		ApiSecret: "node_secret",
+		Tenants: []*config.TenantConfig{
+			{Name: "a", ApiKey: "key_a", ApiSecret: "secret_a"},
+			{Name: "b", ApiKey: "key_b", ApiSecret: "secret_b"},
+			{Name: "node", ApiKey: "node_key"},
+			{Name: "prefix", RoomPrefix: "prefix-"},
+		},
+	}
+
+	for _, test := range []struct {
+		name     string
+		key      string
+		secret   string
+		roomName string
+		expected string
+	}{
+		{name: "tenant a", key: "key_a", secret: "secret_a", expected: "a"},
+		{name: "tenant b", key: "key_b", secret: "secret_b", expected: "b"},
+		{name: "node key", key: "node_key", secret: "node_secret", expected: "node"},
+		{name: "wrong secret", key: "key_a", secret: "secret_b"},
+		{name: "unknown key", key: "key_c", secret: "secret_c"},
+		{name: "room prefix", roomName: "prefix-room", expected: "prefix"},
+		{name: "no match"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := &livekit.StartEgressRequest{
+				Request: &livekit.StartEgressRequest_RoomComposite{
+					RoomComposite: &livekit.RoomCompositeEgressRequest{RoomName: test.roomName},
+				},
+			}
+			if test.key != "" {
+				token, err := auth.NewAccessToken(test.key, test.secret).
+					AddGrant(&auth.VideoGrant{RoomRecord: true}).
+					ToJWT()
+				require.NoError(t, err)
+				req.Token = token
+			}
+
+			tenant := getTenant(conf, req, params.GetRequestMetadata(conf, req))
+			if test.expected == "" {
+				require.Nil(t, tenant)
+			} else {
+				require.NotNil(t, tenant)
+				require.Equal(t, test.expected, tenant.Name)
+			}
+		})
+	}
+}
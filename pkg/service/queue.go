@@ -0,0 +1,160 @@
+package service
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+type queuedRequest struct {
+	req      *livekit.StartEgressRequest
+	metadata *params.RequestMetadata
+	priority int
+	deadline time.Time
+}
+
+// requestQueue holds requests which could not be accepted, ordered by priority and then by age
+type requestQueue struct {
+	conf config.QueueConfig
+
+	mu    sync.Mutex
+	items queueHeap
+
+	// signalled when capacity may have freed up
+	ready chan struct{}
+}
+
+func newRequestQueue(conf config.QueueConfig) *requestQueue {
+	return &requestQueue{
+		conf:  conf,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Push queues a request, evicting a lower priority request if the queue is full.
+// It returns the evicted request, and false if the request was not queued
+func (q *requestQueue) Push(req *livekit.StartEgressRequest, metadata *params.RequestMetadata, priority int) (*livekit.StartEgressRequest, bool) {
+	if q.conf.Size <= 0 {
+		return nil, false
+	}
+
+	deadline := time.Unix(0, req.SentAt).Add(q.conf.MaxWait)
+	if time.Now().After(deadline) {
+		return nil, false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var evicted *livekit.StartEgressRequest
+	if len(q.items) >= q.conf.Size {
+		lowest := q.items.lowest()
+		if q.items[lowest].priority >= priority {
+			return nil, false
+		}
+		evicted = heap.Remove(&q.items, lowest).(*queuedRequest).req
+	}
+
+	heap.Push(&q.items, &queuedRequest{
+		req:      req,
+		metadata: metadata,
+		priority: priority,
+		deadline: deadline,
+	})
+	return evicted, true
+}
+
+// Peek returns the next request without removing it
+func (q *requestQueue) Peek() *queuedRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil
+	}
+	return q.items[0]
+}
+
+func (q *requestQueue) Pop() *queuedRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil
+	}
+	return heap.Pop(&q.items).(*queuedRequest)
+}
+
+// Signal wakes the service to retry queued requests
+func (q *requestQueue) Signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *requestQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+func (q *requestQueue) getPriority(req *livekit.StartEgressRequest, metadata *params.RequestMetadata) int {
+	if metadata.Priority != nil {
+		return *metadata.Priority
+	}
+
+	switch req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite:
+		return q.conf.Priority.RoomComposite
+	case *livekit.StartEgressRequest_Web:
+		return q.conf.Priority.Web
+	case *livekit.StartEgressRequest_TrackComposite:
+		return q.conf.Priority.TrackComposite
+	case *livekit.StartEgressRequest_Track:
+		return q.conf.Priority.Track
+	}
+	return 0
+}
+
+// queueHeap implements heap.Interface
+type queueHeap []*queuedRequest
+
+func (h queueHeap) Len() int { return len(h) }
+
+func (h queueHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].req.SentAt < h[j].req.SentAt
+}
+
+func (h queueHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *queueHeap) Push(x interface{}) {
+	*h = append(*h, x.(*queuedRequest))
+}
+
+func (h *queueHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
+
+// lowest returns the index of the last request to be claimed
+func (h queueHeap) lowest() int {
+	lowest := 0
+	for i := range h {
+		if h.Less(lowest, i) {
+			lowest = i
+		}
+	}
+	return lowest
+}
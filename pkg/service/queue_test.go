@@ -0,0 +1,169 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+type queuePush struct {
+	id       string
+	priority int
+	age      time.Duration
+
+	queued  bool
+	evicted string
+}
+
+func TestRequestQueue(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		size   int
+		pushes []queuePush
+		popped []string
+	}{
+		{
+			name: "disabled",
+			size: 0,
+			pushes: []queuePush{
+				{id: "a", queued: false},
+			},
+		},
+		{
+			name: "priority then age",
+			size: 4,
+			pushes: []queuePush{
+				{id: "a", priority: 0, age: time.Millisecond * 300, queued: true},
+				{id: "b", priority: 1, age: time.Millisecond * 100, queued: true},
+				{id: "c", priority: 0, age: time.Millisecond * 400, queued: true},
+				{id: "d", priority: 1, age: time.Millisecond * 200, queued: true},
+			},
+			popped: []string{"d", "b", "c", "a"},
+		},
+		{
+			name: "expired",
+			size: 2,
+			pushes: []queuePush{
+				{id: "a", age: time.Second * 3, queued: false},
+				{id: "b", age: time.Millisecond * 100, queued: true},
+			},
+			popped: []string{"b"},
+		},
+		{
+			name: "evicts lowest priority",
+			size: 2,
+			pushes: []queuePush{
+				{id: "a", priority: 1, queued: true},
+				{id: "b", priority: 0, queued: true},
+				{id: "c", priority: 2, queued: true, evicted: "b"},
+			},
+			popped: []string{"c", "a"},
+		},
+		{
+			name: "evicts newest of lowest priority",
+			size: 2,
+			pushes: []queuePush{
+				{id: "a", priority: 0, age: time.Millisecond * 200, queued: true},
+				{id: "b", priority: 0, age: time.Millisecond * 100, queued: true},
+				{id: "c", priority: 1, queued: true, evicted: "b"},
+			},
+			popped: []string{"c", "a"},
+		},
+		{
+			name: "full",
+			size: 2,
+			pushes: []queuePush{
+				{id: "a", priority: 1, queued: true},
+				{id: "b", priority: 1, queued: true},
+				{id: "c", priority: 1, queued: false},
+				{id: "d", priority: 0, queued: false},
+			},
+			popped: []string{"a", "b"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			q := newRequestQueue(config.QueueConfig{
+				Size:    test.size,
+				MaxWait: time.Second * 2,
+			})
+
+			now := time.Now()
+			for _, push := range test.pushes {
+				req := &livekit.StartEgressRequest{
+					EgressId: push.id,
+					SentAt:   now.Add(-push.age).UnixNano(),
+				}
+				evicted, queued := q.Push(req, &params.RequestMetadata{}, push.priority)
+				require.Equal(t, push.queued, queued, push.id)
+				if push.evicted == "" {
+					require.Nil(t, evicted, push.id)
+				} else {
+					require.NotNil(t, evicted, push.id)
+					require.Equal(t, push.evicted, evicted.EgressId, push.id)
+				}
+			}
+
+			require.Equal(t, len(test.popped), q.Len())
+			if len(test.popped) > 0 {
+				require.Equal(t, test.popped[0], q.Peek().req.EgressId)
+			}
+			for _, id := range test.popped {
+				require.Equal(t, id, q.Pop().req.EgressId)
+			}
+			require.Nil(t, q.Peek())
+			require.Nil(t, q.Pop())
+		})
+	}
+}
+
+func TestRequestQueuePriority(t *testing.T) {
+	priority := 7
+	q := newRequestQueue(config.QueueConfig{
+		Priority: config.QueuePriorityConfig{
+			RoomComposite: 1,
+			Web:           2,
+			Track:         3,
+		},
+	})
+
+	for _, test := range []struct {
+		name     string
+		req      *livekit.StartEgressRequest
+		metadata *params.RequestMetadata
+		expected int
+	}{
+		{
+			name:     "room composite",
+			req:      &livekit.StartEgressRequest{Request: &livekit.StartEgressRequest_RoomComposite{}},
+			metadata: &params.RequestMetadata{},
+			expected: 1,
+		},
+		{
+			name:     "web",
+			req:      &livekit.StartEgressRequest{Request: &livekit.StartEgressRequest_Web{}},
+			metadata: &params.RequestMetadata{},
+			expected: 2,
+		},
+		{
+			name:     "track composite",
+			req:      &livekit.StartEgressRequest{Request: &livekit.StartEgressRequest_TrackComposite{}},
+			metadata: &params.RequestMetadata{},
+			expected: 0,
+		},
+		{
+			name:     "metadata",
+			req:      &livekit.StartEgressRequest{Request: &livekit.StartEgressRequest_Track{}},
+			metadata: &params.RequestMetadata{Priority: &priority},
+			expected: priority,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, q.getPriority(test.req, test.metadata))
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+	"github.com/abdulhaseeb08/protocol/livekit"
+	"github.com/abdulhaseeb08/protocol/logger"
+)
+
+const (
+	// active egresses and recorded minutes are updated at this interval
+	quotaRefreshInterval = time.Second * 30
+
+	// active egresses which have not been refreshed are assumed to have crashed
+	quotaActiveTTL = quotaRefreshInterval * 3
+)
+
+// quotaTracker enforces tenant quotas across all nodes. Checks are not atomic with claims,
+// so a tenant starting many egresses at once may briefly exceed its concurrency limit
+type quotaTracker struct {
+	rc redis.UniversalClient
+
+	mu     sync.Mutex
+	active map[string]*quotaEgress
+}
+
+type quotaEgress struct {
+	tenant      *config.TenantConfig
+	lastCharged time.Time
+}
+
+func newQuotaTracker(rc redis.UniversalClient) *quotaTracker {
+	return &quotaTracker{
+		rc:     rc,
+		active: make(map[string]*quotaEgress),
+	}
+}
+
+// Check returns an error if starting the request would exceed the tenant's quotas
+func (q *quotaTracker) Check(ctx context.Context, tenant *config.TenantConfig, req *livekit.StartEgressRequest) error {
+	if tenant.MaxStreams > 0 && getStreamCount(req) > tenant.MaxStreams {
+		return errors.ErrQuotaExceeded(tenant.Name, "stream destinations", tenant.MaxStreams)
+	}
+
+	if tenant.MaxConcurrent > 0 {
+		key := activeKey(tenant)
+		expired := strconv.FormatInt(time.Now().Add(-quotaActiveTTL).Unix(), 10)
+		if err := q.rc.ZRemRangeByScore(ctx, key, "-inf", expired).Err(); err != nil {
+			return err
+		}
+		count, err := q.rc.ZCard(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if count >= int64(tenant.MaxConcurrent) {
+			return errors.ErrQuotaExceeded(tenant.Name, "concurrent egresses", tenant.MaxConcurrent)
+		}
+	}
+
+	if tenant.MaxMinutes > 0 {
+		minutes, err := q.rc.Get(ctx, minutesKey(tenant, time.Now())).Float64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if minutes >= tenant.MaxMinutes {
+			return errors.ErrQuotaExceeded(tenant.Name, "recording minutes", tenant.MaxMinutes)
+		}
+	}
+
+	return nil
+}
+
+// Start counts an egress against its tenant's quotas until End is called
+func (q *quotaTracker) Start(ctx context.Context, tenant *config.TenantConfig, egressID string) {
+	now := time.Now()
+	if err := q.rc.ZAdd(ctx, activeKey(tenant), &redis.Z{Score: float64(now.Unix()), Member: egressID}).Err(); err != nil {
+		logger.Warnw("failed to update tenant quota", err, "tenant", tenant.Name)
+	}
+
+	q.mu.Lock()
+	q.active[egressID] = &quotaEgress{
+		tenant:      tenant,
+		lastCharged: now,
+	}
+	q.mu.Unlock()
+}
+
+func (q *quotaTracker) End(egressID string) {
+	q.mu.Lock()
+	e := q.active[egressID]
+	delete(q.active, egressID)
+	q.mu.Unlock()
+
+	if e == nil {
+		return
+	}
+
+	ctx := context.Background()
+	q.charge(ctx, e, time.Now())
+	if err := q.rc.ZRem(ctx, activeKey(e.tenant), egressID).Err(); err != nil {
+		logger.Warnw("failed to update tenant quota", err, "tenant", e.tenant.Name)
+	}
+}
+
+// Run refreshes active egresses and charges recorded minutes until done is closed
+func (q *quotaTracker) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(quotaRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			q.refresh()
+		}
+	}
+}
+
+func (q *quotaTracker) refresh() {
+	ctx := context.Background()
+	now := time.Now()
+
+	q.mu.Lock()
+	active := make(map[string]*quotaEgress, len(q.active))
+	for egressID, e := range q.active {
+		active[egressID] = e
+	}
+	q.mu.Unlock()
+
+	for egressID, e := range active {
+		if err := q.rc.ZAdd(ctx, activeKey(e.tenant), &redis.Z{Score: float64(now.Unix()), Member: egressID}).Err(); err != nil {
+			logger.Warnw("failed to update tenant quota", err, "tenant", e.tenant.Name)
+		}
+		q.charge(ctx, e, now)
+	}
+}
+
+// charge adds the minutes recorded since the last charge to the tenant's current window
+func (q *quotaTracker) charge(ctx context.Context, e *quotaEgress, now time.Time) {
+	q.mu.Lock()
+	minutes := now.Sub(e.lastCharged).Minutes()
+	e.lastCharged = now
+	q.mu.Unlock()
+
+	if e.tenant.MaxMinutes <= 0 || minutes <= 0 {
+		return
+	}
+
+	key := minutesKey(e.tenant, now)
+	pipe := q.rc.TxPipeline()
+	pipe.IncrByFloat(ctx, key, minutes)
+	pipe.Expire(ctx, key, e.tenant.Window*2)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Warnw("failed to update tenant quota", err, "tenant", e.tenant.Name)
+	}
+}
+
+func activeKey(tenant *config.TenantConfig) string {
+	return fmt.Sprintf("egress_quota:%s:active", tenant.Name)
+}
+
+func minutesKey(tenant *config.TenantConfig, now time.Time) string {
+	return fmt.Sprintf("egress_quota:%s:minutes:%d", tenant.Name, now.Truncate(tenant.Window).Unix())
+}
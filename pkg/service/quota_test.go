@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+func newTestQuotaTracker(t *testing.T) (*quotaTracker, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rc.Close() })
+	return newQuotaTracker(rc), mr
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	ctx := context.Background()
+	q, mr := newTestQuotaTracker(t)
+	tenant := &config.TenantConfig{Name: "tenant", MaxConcurrent: 2}
+	req := &livekit.StartEgressRequest{}
+
+	q.Start(ctx, tenant, "a")
+	require.NoError(t, q.Check(ctx, tenant, req))
+	q.Start(ctx, tenant, "b")
+
+	err := q.Check(ctx, tenant, req)
+	require.True(t, errors.IsQuotaExceeded(err))
+
+	members, err := mr.ZMembers(activeKey(tenant))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"a", "b"}, members)
+
+	q.End("a")
+	require.NoError(t, q.Check(ctx, tenant, req))
+
+	// egresses which have not been refreshed are removed
+	q.Start(ctx, tenant, "c")
+	_, err = mr.ZAdd(activeKey(tenant), float64(time.Now().Add(-quotaActiveTTL*2).Unix()), "c")
+	require.NoError(t, err)
+	require.NoError(t, q.Check(ctx, tenant, req))
+	members, err = mr.ZMembers(activeKey(tenant))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"b"}, members)
+
+	// refreshing restores it
+	q.refresh()
+	members, err = mr.ZMembers(activeKey(tenant))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"b", "c"}, members)
+	err = q.Check(ctx, tenant, req)
+	require.True(t, errors.IsQuotaExceeded(err))
+}
+
+func TestQuotaMinutes(t *testing.T) {
+	ctx := context.Background()
+	q, mr := newTestQuotaTracker(t)
+	tenant := &config.TenantConfig{Name: "tenant", MaxMinutes: 5, Window: time.Hour}
+	req := &livekit.StartEgressRequest{}
+
+	q.Start(ctx, tenant, "a")
+	require.NoError(t, q.Check(ctx, tenant, req))
+
+	now := time.Now()
+	key := minutesKey(tenant, now)
+
+	// charge three minutes
+	q.active["a"].lastCharged = now.Add(-time.Minute * 3)
+	q.charge(ctx, q.active["a"], now)
+	requireMinutes(t, mr, key, 3)
+	require.Equal(t, tenant.Window*2, mr.TTL(key))
+	require.NoError(t, q.Check(ctx, tenant, req))
+
+	// charges are cumulative, and End charges the remaining time
+	q.active["a"].lastCharged = now.Add(-time.Minute * 2)
+	q.End("a")
+	requireMinutes(t, mr, key, 5)
+	err := q.Check(ctx, tenant, req)
+	require.True(t, errors.IsQuotaExceeded(err))
+
+	// charged minutes expire after two windows
+	mr.FastForward(tenant.Window * 2)
+	require.NoError(t, q.Check(ctx, tenant, req))
+}
+
+func TestQuotaStreams(t *testing.T) {
+	ctx := context.Background()
+	q, _ := newTestQuotaTracker(t)
+	tenant := &config.TenantConfig{Name: "tenant", MaxStreams: 1}
+
+	req := &livekit.StartEgressRequest{
+		Request: &livekit.StartEgressRequest_RoomComposite{
+			RoomComposite: &livekit.RoomCompositeEgressRequest{
+				Output: &livekit.RoomCompositeEgressRequest_Stream{
+					Stream: &livekit.StreamOutput{Urls: []string{"rtmp://a"}},
+				},
+			},
+		},
+	}
+	require.NoError(t, q.Check(ctx, tenant, req))
+
+	req.GetRoomComposite().GetStream().Urls = append(req.GetRoomComposite().GetStream().Urls, "rtmp://b")
+	err := q.Check(ctx, tenant, req)
+	require.True(t, errors.IsQuotaExceeded(err))
+}
+
+func TestCheckQuota(t *testing.T) {
+	ctx := context.Background()
+	q, mr := newTestQuotaTracker(t)
+	tenant := &config.TenantConfig{Name: "tenant", MaxConcurrent: 1}
+	s := &Service{
+		conf:   &config.Config{Tenants: []*config.TenantConfig{tenant}},
+		quotas: q,
+	}
+
+	metadata := &params.RequestMetadata{Tenant: tenant.Name}
+	req := &livekit.StartEgressRequest{}
+
+	// requests without a tenant are not checked
+	q.Start(ctx, tenant, "a")
+	require.NoError(t, s.checkQuota(ctx, req, &params.RequestMetadata{}))
+
+	err := s.checkQuota(ctx, req, metadata)
+	require.True(t, errors.IsQuotaExceeded(err))
+
+	// requests are not blocked while redis is unavailable
+	mr.Close()
+	require.NoError(t, s.checkQuota(ctx, req, metadata))
+}
+
+func requireMinutes(t *testing.T, mr *miniredis.Miniredis, key string, expected float64) {
+	v, err := mr.Get(key)
+	require.NoError(t, err)
+	minutes, err := strconv.ParseFloat(v, 64)
+	require.NoError(t, err)
+	require.InDelta(t, expected, minutes, 0.001)
+}
@@ -14,22 +14,26 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"go.uber.org/atomic"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 	"gopkg.in/yaml.v3"
 
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/params"
 	"github.com/abdulhaseeb08/egress-ehancement/pkg/stats"
 	"github.com/abdulhaseeb08/egress-ehancement/version"
 	"github.com/abdulhaseeb08/protocol/egress"
 	"github.com/abdulhaseeb08/protocol/livekit"
 	"github.com/abdulhaseeb08/protocol/logger"
+	"github.com/abdulhaseeb08/protocol/redis"
 	"github.com/abdulhaseeb08/protocol/tracer"
 )
 
-const shutdownTimer = time.Second * 30
+const (
+	shutdownTimer      = time.Second * 30
+	queueCheckInterval = time.Millisecond * 500
+)
 
 type Service struct {
 	conf       *config.Config
@@ -37,7 +41,12 @@ type Service struct {
 	promServer *http.Server
 	monitor    *stats.Monitor
 
-	handlingWeb atomic.Bool
+	displays    *displayAllocator
+	warmPool    *warmPool
+	handlerPool *handlerPool
+	ipcServer   *ipcServer
+	queue       *requestQueue
+	quotas      *quotaTracker
 	processes   sync.Map
 	shutdown    chan struct{}
 }
@@ -52,8 +61,11 @@ func NewService(conf *config.Config, rpcServer egress.RPCServer) *Service {
 		conf:      conf,
 		rpcServer: rpcServer,
 		monitor:   stats.NewMonitor(),
+		displays:  newDisplayAllocator(),
+		queue:     newRequestQueue(conf.Queue),
 		shutdown:  make(chan struct{}),
 	}
+	s.warmPool = newWarmPool(conf, s.displays)
 
 	if conf.PrometheusPort > 0 {
 		s.promServer = &http.Server{
@@ -82,6 +94,44 @@ func (s *Service) Run() error {
 		return err
 	}
 
+	// handlers report their status over a local socket
+	ipcServer, err := newIPCServer(s.conf.NodeID)
+	if err != nil {
+		return err
+	}
+	s.ipcServer = ipcServer
+	defer s.ipcServer.Close()
+	s.monitor.RegisterHandlerStats(s.ipcServer.GetMetrics)
+	s.ipcServer.OnMetrics(s.monitor.RecordHandlerMetrics)
+	s.ipcServer.OnUpload(s.monitor.RecordUpload)
+	s.ipcServer.OnStall(s.monitor.RecordStall)
+
+	// quotas are shared by all nodes
+	if len(s.conf.Tenants) > 0 {
+		rc, err := redis.GetRedisClient(s.conf.Redis)
+		if err != nil {
+			return err
+		}
+		s.quotas = newQuotaTracker(rc)
+		go s.quotas.Run(s.shutdown)
+	}
+
+	// clean up after handlers which did not exit cleanly
+	s.startJanitor()
+
+	// pre-launch web environments
+	s.warmPool.fill()
+	defer s.warmPool.Close()
+
+	// pre-spawn sdk handlers
+	handlerPool, err := newHandlerPool(s.conf, s.ipcServer.socketPath)
+	if err != nil {
+		return err
+	}
+	s.handlerPool = handlerPool
+	s.handlerPool.fill()
+	defer s.handlerPool.Close()
+
 	requests, err := s.rpcServer.GetRequestChannel(context.Background())
 	if err != nil {
 		return err
@@ -91,6 +141,11 @@ func (s *Service) Run() error {
 		_ = requests.Close()
 	}()
 
+	// retry queued requests as cpu usage changes
+	s.monitor.RegisterQueueStats(s.queue.Len)
+	queueTicker := time.NewTicker(queueCheckInterval)
+	defer queueTicker.Stop()
+
 	logger.Debugw("service ready")
 
 	for {
@@ -113,33 +168,36 @@ func (s *Service) Run() error {
 			}
 
 			if s.acceptRequest(ctx, req) {
-				// validate before launching handler
-				info, err := params.ValidateRequest(ctx, s.conf, req)
-				s.sendResponse(ctx, req, info, err)
-				if err != nil {
-					span.RecordError(err)
-					span.End()
-					continue
-				}
-
-				switch req.Request.(type) {
-				case *livekit.StartEgressRequest_RoomComposite,
-					*livekit.StartEgressRequest_Web:
-					s.handlingWeb.Store(true)
-					go func() {
-						s.launchHandler(ctx, req)
-						s.handlingWeb.Store(false)
-					}()
-				default:
-					go s.launchHandler(ctx, req)
-				}
+				s.startRequest(ctx, req)
 			}
 
 			span.End()
+
+		case <-s.queue.ready:
+			s.processQueue()
+
+		case <-queueTicker.C:
+			s.processQueue()
 		}
 	}
 }
 
+func (s *Service) startRequest(ctx context.Context, req *livekit.StartEgressRequest) {
+	ctx, span := tracer.Start(ctx, "Service.startRequest")
+	defer span.End()
+
+	// validate before launching handler
+	p, err := params.GetPipelineParams(ctx, s.conf, req)
+	s.sendResponse(ctx, req, p.Info, err)
+	if err != nil {
+		span.RecordError(err)
+		s.releaseRequest(req)
+		return
+	}
+
+	go s.launchHandler(ctx, req, p)
+}
+
 func (s *Service) isIdle() bool {
 	idle := true
 	s.processes.Range(func(key, value interface{}) bool {
@@ -149,6 +207,15 @@ func (s *Service) isIdle() bool {
 	return idle
 }
 
+func (s *Service) shuttingDown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Service) isAvailable() float64 {
 	if s.isIdle() {
 		return 1
@@ -172,34 +239,78 @@ func (s *Service) acceptRequest(ctx context.Context, req *livekit.StartEgressReq
 		return false
 	}
 
-	if s.handlingWeb.Load() {
-		args = append(args, "reason", "already handling room composite")
+	// check routing constraints
+	metadata := params.GetRequestMetadata(s.conf, req)
+	if !metadata.MatchesLabels(s.conf.Labels, s.conf.Dedicated) {
+		args = append(args, "reason", "constraints not matched")
 		logger.Debugw("rejecting request", args...)
 		return false
 	}
 
-	// check cpu load
-	switch req.Request.(type) {
-	case *livekit.StartEgressRequest_RoomComposite,
-		*livekit.StartEgressRequest_Web:
-		// limit to one web composite at a time for now
-		if !s.isIdle() {
-			args = append(args, "reason", "already recording")
-			logger.Debugw("rejecting request", args...)
-			return false
-		}
-	default:
-		// continue
+	// check tenant quotas
+	if err := s.checkQuota(ctx, req, metadata); err != nil {
+		s.rejectRequest(ctx, req, err, args)
+		return false
 	}
 
-	if !s.monitor.CanAcceptRequest(req) {
-		args = append(args, "reason", "not enough cpu")
-		logger.Debugw("rejecting request", args...)
+	if reason := s.checkCapacity(req); reason != "" {
+		s.queueRequest(req, metadata, reason, args)
 		return false
 	}
 
-	// claim request
-	claimed, err := s.rpcServer.ClaimRequest(context.Background(), req)
+	return s.claimRequest(ctx, req, args)
+}
+
+// checkCapacity returns the reason a request can't be accepted, or an empty string
+func (s *Service) checkCapacity(req *livekit.StartEgressRequest) string {
+	if !s.monitor.CanAcceptRequest(req) {
+		return "not enough cpu or memory"
+	}
+	if !s.monitor.CanAcceptDisk(req) {
+		return "not enough disk space"
+	}
+	return ""
+}
+
+// checkQuota returns an error if the request would exceed the quotas of its tenant
+func (s *Service) checkQuota(ctx context.Context, req *livekit.StartEgressRequest, metadata *params.RequestMetadata) error {
+	if s.quotas == nil {
+		return nil
+	}
+	tenant := getTenant(s.conf, req, metadata)
+	if tenant == nil {
+		return nil
+	}
+
+	err := s.quotas.Check(ctx, tenant, req)
+	if err != nil && !errors.IsQuotaExceeded(err) {
+		// don't block requests while redis is unavailable
+		logger.Warnw("could not check tenant quota", err, "tenant", tenant.Name)
+		return nil
+	}
+	return err
+}
+
+// rejectRequest claims a request which no node can accept, so that a single response is sent with the reason
+func (s *Service) rejectRequest(ctx context.Context, req *livekit.StartEgressRequest, reason error, args []interface{}) {
+	logger.Debugw("rejecting request", append(args, "reason", reason.Error())...)
+
+	claimed, err := s.rpcServer.ClaimRequest(ctx, req)
+	if err != nil || !claimed {
+		return
+	}
+
+	info := &livekit.EgressInfo{
+		EgressId: req.EgressId,
+		RoomId:   req.RoomId,
+		Status:   livekit.EgressStatus_EGRESS_FAILED,
+		Error:    reason.Error(),
+	}
+	s.sendResponse(ctx, req, info, reason)
+}
+
+func (s *Service) claimRequest(ctx context.Context, req *livekit.StartEgressRequest, args []interface{}) bool {
+	claimed, err := s.rpcServer.ClaimRequest(ctx, req)
 	if err != nil {
 		logger.Warnw("could not claim request", err, args...)
 		return false
@@ -213,6 +324,65 @@ func (s *Service) acceptRequest(ctx context.Context, req *livekit.StartEgressReq
 	return true
 }
 
+// releaseRequest frees the capacity held for a claimed request which won't be launched
+func (s *Service) releaseRequest(req *livekit.StartEgressRequest) {
+	s.monitor.ReleaseRequest(req)
+	s.queue.Signal()
+}
+
+// queueRequest holds a request until capacity frees up, or rejects it if the queue is disabled or full
+func (s *Service) queueRequest(req *livekit.StartEgressRequest, metadata *params.RequestMetadata, reason string, args []interface{}) {
+	priority := s.queue.getPriority(req, metadata)
+	evicted, queued := s.queue.Push(req, metadata, priority)
+	if !queued {
+		logger.Debugw("rejecting request", append(args, "reason", reason)...)
+		return
+	}
+
+	logger.Debugw("request queued", append(args, "reason", reason, "priority", priority)...)
+	if evicted != nil {
+		logger.Debugw("dropping queued request", "egressID", evicted.EgressId, "reason", "evicted")
+		s.monitor.QueueDropped("evicted")
+	}
+}
+
+// processQueue claims queued requests in order until one can't be accepted
+func (s *Service) processQueue() {
+	for {
+		item := s.queue.Peek()
+		if item == nil || s.shuttingDown() {
+			return
+		}
+
+		if time.Now().After(item.deadline) {
+			s.queue.Pop()
+			logger.Debugw("dropping queued request", "egressID", item.req.EgressId, "reason", "expired")
+			s.monitor.QueueDropped("expired")
+			continue
+		}
+
+		if s.checkCapacity(item.req) != "" {
+			return
+		}
+		s.queue.Pop()
+
+		ctx, span := tracer.Start(context.Background(), "Service.HandleQueuedRequest")
+		args := []interface{}{
+			"egressID", item.req.EgressId,
+			"requestID", item.req.RequestId,
+			"senderID", item.req.SenderId,
+			"queuedFor", time.Since(time.Unix(0, item.req.SentAt)),
+		}
+		// the tenant may have started other egresses while this one was queued
+		if err := s.checkQuota(ctx, item.req, item.metadata); err != nil {
+			s.rejectRequest(ctx, item.req, err, args)
+		} else if s.claimRequest(ctx, item.req, args) {
+			s.startRequest(ctx, item.req)
+		}
+		span.End()
+	}
+}
+
 func (s *Service) sendResponse(ctx context.Context, req *livekit.StartEgressRequest, info *livekit.EgressInfo, err error) {
 	if err != nil {
 		logger.Infow("bad request",
@@ -228,7 +398,7 @@ func (s *Service) sendResponse(ctx context.Context, req *livekit.StartEgressRequ
 	}
 }
 
-func (s *Service) launchHandler(ctx context.Context, req *livekit.StartEgressRequest) {
+func (s *Service) launchHandler(ctx context.Context, req *livekit.StartEgressRequest, p *params.Params) {
 	ctx, span := tracer.Start(ctx, "Service.launchHandler")
 	defer span.End()
 
@@ -236,6 +406,7 @@ func (s *Service) launchHandler(ctx context.Context, req *livekit.StartEgressReq
 	if err != nil {
 		span.RecordError(err)
 		logger.Errorw("could not marshal config", err)
+		s.releaseRequest(req)
 		return
 	}
 
@@ -243,52 +414,208 @@ func (s *Service) launchHandler(ctx context.Context, req *livekit.StartEgressReq
 	if err != nil {
 		span.RecordError(err)
 		logger.Errorw("could not marshal request", err)
+		s.releaseRequest(req)
 		return
 	}
 
 	tempPath := path.Join(os.TempDir(), req.EgressId)
-
-	cmd := exec.Command("egress",
+	args := []string{
 		"run-handler",
 		"--config-body", string(confString),
 		"--request", string(reqString),
 		"--temp-path", tempPath,
-	)
+		"--ipc-socket", s.ipcServer.socketPath,
+	}
+
+	if s.quotas != nil {
+		if tenant := getTenant(s.conf, req, params.GetRequestMetadata(s.conf, req)); tenant != nil {
+			s.quotas.Start(ctx, tenant, req.EgressId)
+			defer s.quotas.End(req.EgressId)
+		}
+	}
+
+	s.monitor.EgressStarted(req)
+	defer func() {
+		s.monitor.EgressEnded(req)
+		s.processes.Delete(req.EgressId)
+		s.ipcServer.Remove(req.EgressId)
+		logger.Debugw("deleting handler temporary directory", "path", tempPath)
+		_ = os.RemoveAll(tempPath)
+
+		// capacity has freed up
+		s.queue.Signal()
+	}()
+
+	info := p.Info
+	switch req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite,
+		*livekit.StartEgressRequest_Web:
+		env, err := s.getWebEnv(p)
+		if err != nil {
+			span.RecordError(err)
+			s.sendFailed(ctx, info, err)
+			return
+		}
+		defer s.releaseWebEnv(env)
+
+		envString, err := json.Marshal(env)
+		if err != nil {
+			span.RecordError(err)
+			s.sendFailed(ctx, info, err)
+			return
+		}
+		args = append(args, "--web-env", string(envString))
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err = s.runHandler(req, args, &PooledRequest{
+			Request:  string(reqString),
+			TempPath: tempPath,
+		}); err != nil {
+			logger.Errorw("could not launch handler", err, "egressID", req.EgressId)
+		}
+
+		last := s.getHandlerStatus(req.EgressId, tempPath)
+		if last != nil && isFinalStatus(last.Status) {
+			return
+		}
+
+		// nothing has been recorded yet if the handler died before becoming active
+		if attempt < s.conf.HandlerRelaunches && !s.shuttingDown() &&
+			(last == nil || last.Status == livekit.EgressStatus_EGRESS_STARTING) {
+			logger.Infow("relaunching handler", "egressID", req.EgressId, "attempt", attempt+1)
+			_ = os.Remove(path.Join(tempPath, handlerStatusFile))
+			s.ipcServer.Remove(req.EgressId)
+			continue
+		}
+
+		if last != nil {
+			info = last
+		}
+		s.sendFailed(ctx, info, errors.ErrHandlerExited(err))
+		return
+	}
+}
+
+// runHandler runs the request on a pre-spawned handler if one is available, otherwise it launches a new process
+func (s *Service) runHandler(req *livekit.StartEgressRequest, args []string, pr *PooledRequest) error {
+	if ph := s.handlerPool.Claim(req); ph != nil {
+		s.processes.Store(req.EgressId, &process{
+			req: req,
+			cmd: ph.cmd,
+		})
+		return s.handlerPool.Run(ph, pr)
+	}
+
+	cmd := exec.Command("egress", args...)
 	cmd.Dir = "/"
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	s.monitor.EgressStarted(req)
 	s.processes.Store(req.EgressId, &process{
 		req: req,
 		cmd: cmd,
 	})
 
-	defer func() {
-		s.monitor.EgressEnded(req)
-		s.processes.Delete(req.EgressId)
-		logger.Debugw("deleting handler temporary directory", "path", tempPath)
-		_ = os.RemoveAll(tempPath)
-	}()
+	return cmd.Run()
+}
+
+// getWebEnv claims a warm environment if one is available, otherwise it reserves a display for the handler
+func (s *Service) getWebEnv(p *params.Params) (*webEnv, error) {
+	if env := s.warmPool.Claim(p.Width, p.Height, p.Depth); env != nil {
+		logger.Debugw("using warm environment", "egressID", p.Info.EgressId, "display", env.Display)
+		return env, nil
+	}
+
+	// each web egress needs its own display
+	display, err := s.displays.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	return &webEnv{Display: display}, nil
+}
+
+func (s *Service) releaseWebEnv(env *webEnv) {
+	if env.DevToolsUrl != "" {
+		s.warmPool.Release(env)
+	} else {
+		s.displays.Release(env.Display)
+	}
+}
+
+// sendFailed sends the final update for an egress whose handler could not report it
+func (s *Service) sendFailed(ctx context.Context, info *livekit.EgressInfo, err error) {
+	if info == nil {
+		return
+	}
 
-	if err = cmd.Run(); err != nil {
-		logger.Errorw("could not launch handler", err)
+	if info.StartedAt != 0 {
+		info.EndedAt = time.Now().UnixNano()
+	}
+	info.Status = livekit.EgressStatus_EGRESS_FAILED
+	info.Error = err.Error()
+
+	logger.Warnw("egress failed", err, "egressID", info.EgressId)
+	if err = s.rpcServer.SendUpdate(ctx, info); err != nil {
+		logger.Errorw("failed to send update", err)
+	}
+}
+
+func isFinalStatus(status livekit.EgressStatus) bool {
+	switch status {
+	case livekit.EgressStatus_EGRESS_COMPLETE,
+		livekit.EgressStatus_EGRESS_FAILED,
+		livekit.EgressStatus_EGRESS_ABORTED,
+		livekit.EgressStatus_EGRESS_LIMIT_REACHED:
+		return true
+	default:
+		return false
 	}
 }
 
 func (s *Service) Status() ([]byte, error) {
 	info := map[string]interface{}{
-		"CpuLoad": s.monitor.GetCPULoad(),
+		"CpuLoad":  s.monitor.GetCPULoad(),
+		"CpuCosts": s.monitor.GetCPUCosts(),
+		"Labels":   s.conf.Labels,
 	}
 	s.processes.Range(func(key, value interface{}) bool {
-		p := value.(*process)
-		info[key.(string)] = p.req.Request
+		egressID := key.(string)
+		if status := s.ipcServer.GetStatus(egressID); status != nil {
+			info[egressID] = status
+		} else {
+			info[egressID] = value.(*process).req.Request
+		}
 		return true
 	})
 
 	return json.Marshal(info)
 }
 
+// StopEgress asks a handler to finish its egress
+func (s *Service) StopEgress(egressID string) bool {
+	return s.ipcServer.SendControl(egressID, &ipcControl{Type: ipcControlStop})
+}
+
+// KillEgress asks a handler to end its egress immediately, without uploading
+func (s *Service) KillEgress(egressID string) bool {
+	return s.ipcServer.SendControl(egressID, &ipcControl{Type: ipcControlKill})
+}
+
+// SetLogLevel changes the log level of the service and all running handlers
+func (s *Service) SetLogLevel(level string) error {
+	if err := s.conf.SetLogLevel(level); err != nil {
+		return err
+	}
+
+	ctrl := &ipcControl{Type: ipcControlLogLevel, LogLevel: level}
+	s.processes.Range(func(key, _ interface{}) bool {
+		s.ipcServer.SendControl(key.(string), ctrl)
+		return true
+	})
+	return nil
+}
+
 func (s *Service) Stop(kill bool) {
 	select {
 	case <-s.shutdown:
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/pipeline/input/web"
+	"github.com/abdulhaseeb08/protocol/logger"
+)
+
+// webEnv is the display, audio sink and browser used by a web egress, passed to the handler as json
+type webEnv struct {
+	Display     string `json:"display"`
+	PulseSink   string `json:"pulse_sink,omitempty"`
+	DevToolsUrl string `json:"devtools_url,omitempty"`
+	Pids        []int  `json:"pids,omitempty"` // moved under the limits of the handler
+
+	// owned by the service
+	pulseModule string
+	xvfb        *exec.Cmd
+	profileDir  string
+	chromeCtx   context.Context
+	cancel      []context.CancelFunc
+}
+
+// warmPool keeps web environments running so that web requests only need to navigate
+type warmPool struct {
+	conf     config.WarmPoolConfig
+	insecure bool
+	displays *displayAllocator
+
+	mu      sync.Mutex
+	envs    []*webEnv
+	pending int
+	closed  bool
+}
+
+func newWarmPool(conf *config.Config, displays *displayAllocator) *warmPool {
+	return &warmPool{
+		conf:     conf.WarmPool,
+		insecure: conf.Insecure,
+		displays: displays,
+	}
+}
+
+// fill launches environments until the pool is full
+func (w *warmPool) fill() {
+	w.mu.Lock()
+	missing := w.conf.Size - len(w.envs) - w.pending
+	if w.closed || missing <= 0 {
+		w.mu.Unlock()
+		return
+	}
+	w.pending += missing
+	w.mu.Unlock()
+
+	for i := 0; i < missing; i++ {
+		go func() {
+			env, err := w.launch()
+
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.pending--
+
+			if err != nil {
+				logger.Warnw("failed to launch warm environment", err)
+				return
+			}
+			if w.closed {
+				w.destroy(env)
+				return
+			}
+			w.envs = append(w.envs, env)
+		}()
+	}
+}
+
+// Claim returns a running environment with the given dimensions, or nil if none are available
+func (w *warmPool) Claim(width, height, depth int32) *webEnv {
+	if w.conf.Size <= 0 || width != w.conf.Width || height != w.conf.Height || depth != w.conf.Depth {
+		return nil
+	}
+
+	w.mu.Lock()
+	var env *webEnv
+	for len(w.envs) > 0 && env == nil {
+		env, w.envs = w.envs[0], w.envs[1:]
+		if env.chromeCtx.Err() != nil {
+			// chrome exited while waiting
+			w.destroy(env)
+			env = nil
+		}
+	}
+	w.mu.Unlock()
+
+	go w.fill()
+	return env
+}
+
+// Release destroys a claimed environment, which is not reused since the page may have changed its state
+func (w *warmPool) Release(env *webEnv) {
+	w.mu.Lock()
+	w.destroy(env)
+	w.mu.Unlock()
+}
+
+func (w *warmPool) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	for _, env := range w.envs {
+		w.destroy(env)
+	}
+	w.envs = nil
+}
+
+func (w *warmPool) launch() (*webEnv, error) {
+	display, err := w.displays.Allocate()
+	if err != nil {
+		return nil, err
+	}
+
+	env := &webEnv{
+		Display:   display,
+		PulseSink: fmt.Sprintf("warm_%s", display[1:]),
+	}
+
+	if env.pulseModule, err = web.CreatePulseSink(env.PulseSink); err != nil {
+		w.destroy(env)
+		return nil, err
+	}
+
+	if env.xvfb, err = web.LaunchXvfb(display, w.conf.Width, w.conf.Height, w.conf.Depth); err != nil {
+		w.destroy(env)
+		return nil, err
+	}
+
+	if env.profileDir, err = os.MkdirTemp("", "chrome-warm-"); err != nil {
+		w.destroy(env)
+		return nil, err
+	}
+
+	// chrome picks its own port, and writes it to the profile directory
+	opts := append(
+		web.ChromeOptions(display, env.PulseSink, env.profileDir, w.conf.Width, w.conf.Height, w.insecure),
+		chromedp.Flag("remote-debugging-port", "0"),
+	)
+	allocCtx, allocCancel := chromedp.NewExecAllocator(context.Background(), opts...)
+	chromeCtx, chromeCancel := chromedp.NewContext(allocCtx)
+	env.chromeCtx = chromeCtx
+	env.cancel = []context.CancelFunc{chromeCancel, allocCancel}
+
+	// start the browser
+	if err = chromedp.Run(chromeCtx); err != nil {
+		w.destroy(env)
+		return nil, err
+	}
+	port, err := readDevToolsActivePort(env.profileDir)
+	if err != nil {
+		w.destroy(env)
+		return nil, err
+	}
+	env.DevToolsUrl = fmt.Sprintf("http://127.0.0.1:%d/", port)
+	env.Pids = []int{env.xvfb.Process.Pid}
+	if proc := chromedp.FromContext(chromeCtx).Browser.Process(); proc != nil {
+		env.Pids = append(env.Pids, proc.Pid)
+	}
+
+	logger.Debugw("warm environment ready", "display", display)
+	return env, nil
+}
+
+func (w *warmPool) destroy(env *webEnv) {
+	for _, cancel := range env.cancel {
+		cancel()
+	}
+
+	if env.xvfb != nil {
+		if err := env.xvfb.Process.Signal(os.Interrupt); err != nil {
+			logger.Errorw("failed to kill xvfb", err)
+		}
+		_ = env.xvfb.Wait()
+	}
+
+	if env.pulseModule != "" {
+		if err := exec.Command("pactl", "unload-module", env.pulseModule).Run(); err != nil {
+			logger.Errorw("failed to unload pulse sink", err)
+		}
+	}
+
+	if env.profileDir != "" {
+		_ = os.RemoveAll(env.profileDir)
+	}
+
+	w.displays.Release(env.Display)
+}
+
+// readDevToolsActivePort reads the debugging port chrome is listening on.
+// The file holds the port, followed by the path of the browser target
+func readDevToolsActivePort(profileDir string) (int, error) {
+	b, err := os.ReadFile(path.Join(profileDir, "DevToolsActivePort"))
+	if err != nil {
+		return 0, err
+	}
+
+	port, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(string(b), "\n", 2)[0]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid DevToolsActivePort: %w", err)
+	}
+	return port, nil
+}
@@ -0,0 +1,263 @@
+package stats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+const (
+	// weight of each new sample in the rolling estimate
+	cpuCostAlpha = 0.1
+
+	// samples needed before an estimate replaces the configured cost. Handlers report every 5s
+	cpuCostMinSamples = 12
+
+	// fraction of the distance between the peak and the mean removed with each sample,
+	// so that a single spike stops inflating the cost after about ten minutes
+	cpuPeakDecay = 0.02
+
+	// stream counts above this share a shape
+	maxShapeStreams = 4
+)
+
+// CPUCostEstimate is the measured cpu usage of a request shape, in cores
+type CPUCostEstimate struct {
+	Cost    float64   `json:"cost"` // rolling mean
+	Peak    float64   `json:"peak"` // decaying peak used for admission, since usage spikes while encoding complex scenes
+	Samples int       `json:"samples"`
+	Updated time.Time `json:"updated"`
+}
+
+type cpuSample struct {
+	shape      string
+	cpuSeconds float64
+	time       time.Time
+}
+
+func (m *Monitor) initCPUCosts() {
+	m.cpuCosts = make(map[string]*CPUCostEstimate)
+	m.cpuSamples = make(map[string]*cpuSample)
+	m.promCPUCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "cpu_cost",
+		ConstLabels: m.constLabels(),
+	}, []string{"shape"})
+	prometheus.MustRegister(m.promCPUCost)
+}
+
+// getCPUCost returns the learned recent peak cost of the request's shape, or the configured cost of its type.
+// ok is false for unknown request types
+func (m *Monitor) getCPUCost(req *livekit.StartEgressRequest) (cost float64, ok bool) {
+	switch req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite:
+		cost = m.cpuCostConfig.RoomCompositeCpuCost
+	case *livekit.StartEgressRequest_Web:
+		cost = m.cpuCostConfig.WebCpuCost
+	case *livekit.StartEgressRequest_TrackComposite:
+		cost = m.cpuCostConfig.TrackCompositeCpuCost
+	case *livekit.StartEgressRequest_Track:
+		cost = m.cpuCostConfig.TrackCpuCost
+	default:
+		return 0, false
+	}
+
+	m.mu.Lock()
+	estimate := m.cpuCosts[GetRequestShape(req)]
+	if estimate != nil && estimate.Samples >= cpuCostMinSamples {
+		cost = estimate.Peak
+	}
+	m.mu.Unlock()
+
+	return cost, true
+}
+
+// recordHandlerCPU updates the estimate for an egress from the cumulative cpu time of its handler
+func (m *Monitor) recordHandlerCPU(egressID string, cpuSeconds float64) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sample := m.cpuSamples[egressID]
+	if sample == nil {
+		return
+	}
+
+	prev := *sample
+	sample.cpuSeconds = cpuSeconds
+	sample.time = now
+
+	// the first report only sets the baseline. Pooled handlers report cpu time from previous requests
+	elapsed := now.Sub(prev.time).Seconds()
+	if prev.time.IsZero() || elapsed <= 0 || cpuSeconds < prev.cpuSeconds {
+		return
+	}
+	cores := (cpuSeconds - prev.cpuSeconds) / elapsed
+
+	estimate := m.cpuCosts[prev.shape]
+	if estimate == nil {
+		estimate = &CPUCostEstimate{Cost: cores, Peak: cores}
+		m.cpuCosts[prev.shape] = estimate
+	} else {
+		estimate.Cost += cpuCostAlpha * (cores - estimate.Cost)
+		estimate.Peak -= cpuPeakDecay * (estimate.Peak - estimate.Cost)
+	}
+	if cores > estimate.Peak {
+		estimate.Peak = cores
+	}
+	estimate.Samples++
+	estimate.Updated = now
+
+	m.promCPUCost.With(prometheus.Labels{"shape": prev.shape}).Set(estimate.Peak)
+}
+
+// GetCPUCosts returns the learned cost table, keyed by request shape
+func (m *Monitor) GetCPUCosts() map[string]CPUCostEstimate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	costs := make(map[string]CPUCostEstimate, len(m.cpuCosts))
+	for shape, estimate := range m.cpuCosts {
+		costs[shape] = *estimate
+	}
+	return costs
+}
+
+func (m *Monitor) startCPUSampling(req *livekit.StartEgressRequest) {
+	m.mu.Lock()
+	m.cpuSamples[req.EgressId] = &cpuSample{shape: GetRequestShape(req)}
+	m.mu.Unlock()
+}
+
+func (m *Monitor) stopCPUSampling(req *livekit.StartEgressRequest) {
+	m.mu.Lock()
+	delete(m.cpuSamples, req.EgressId)
+	m.mu.Unlock()
+}
+
+// GetRequestShape describes the properties of a request which affect its cpu usage,
+// ex. "room_composite/H264_1080P_30/file+stream:2" or "web/720p30_h264_main_opus/stream:4+"
+func GetRequestShape(req *livekit.StartEgressRequest) string {
+	var requestType string
+	var options interface{}
+	var outputs []string
+	var audioOnly, videoOnly bool
+
+	switch r := req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite:
+		requestType = "room_composite"
+		options = r.RoomComposite.Options
+		audioOnly, videoOnly = r.RoomComposite.AudioOnly, r.RoomComposite.VideoOnly
+		outputs = getOutputs(r.RoomComposite.GetFile(), r.RoomComposite.GetStream(), r.RoomComposite.GetSegments())
+	case *livekit.StartEgressRequest_Web:
+		requestType = "web"
+		options = r.Web.Options
+		audioOnly, videoOnly = r.Web.AudioOnly, r.Web.VideoOnly
+		outputs = getOutputs(r.Web.GetFile(), r.Web.GetStream(), r.Web.GetSegments())
+	case *livekit.StartEgressRequest_TrackComposite:
+		requestType = "track_composite"
+		options = r.TrackComposite.Options
+		audioOnly, videoOnly = r.TrackComposite.VideoTrackId == "", r.TrackComposite.AudioTrackId == ""
+		if fs := r.TrackComposite.GetFileAndStream(); fs != nil {
+			outputs = []string{"file", getStreamShape(len(fs.Urls))}
+		} else {
+			outputs = getOutputs(r.TrackComposite.GetFile(), r.TrackComposite.GetStream(), r.TrackComposite.GetSegments())
+		}
+	case *livekit.StartEgressRequest_Track:
+		// tracks are not transcoded
+		if r.Track.GetFile() != nil {
+			return "track/passthrough/file"
+		}
+		return "track/passthrough/websocket"
+	default:
+		return "unknown"
+	}
+
+	encoding := getEncodingShape(options)
+	switch {
+	case audioOnly:
+		encoding = "audio_only"
+	case videoOnly:
+		encoding += "/video_only"
+	}
+
+	return fmt.Sprintf("%s/%s/%s", requestType, encoding, strings.Join(outputs, "+"))
+}
+
+func getEncodingShape(options interface{}) string {
+	var advanced *livekit.EncodingOptions
+	switch opts := options.(type) {
+	case *livekit.RoomCompositeEgressRequest_Preset:
+		return opts.Preset.String()
+	case *livekit.RoomCompositeEgressRequest_Advanced:
+		advanced = opts.Advanced
+	case *livekit.WebEgressRequest_Preset:
+		return opts.Preset.String()
+	case *livekit.WebEgressRequest_Advanced:
+		advanced = opts.Advanced
+	case *livekit.TrackCompositeEgressRequest_Preset:
+		return opts.Preset.String()
+	case *livekit.TrackCompositeEgressRequest_Advanced:
+		advanced = opts.Advanced
+	}
+
+	if advanced == nil {
+		return livekit.EncodingOptionsPreset_H264_1080P_30.String()
+	}
+
+	// advanced options are bucketed, since shapes are used as metric labels
+	return fmt.Sprintf("%s%s_%s_%s",
+		getResolutionBucket(advanced.Width, advanced.Height), getFramerateBucket(advanced.Framerate),
+		strings.ToLower(advanced.VideoCodec.String()), strings.ToLower(advanced.AudioCodec.String()),
+	)
+}
+
+func getResolutionBucket(width, height int32) string {
+	pixels := int64(width) * int64(height)
+	switch {
+	case pixels <= 854*480:
+		return "480p"
+	case pixels <= 1280*720:
+		return "720p"
+	case pixels <= 1920*1080:
+		return "1080p"
+	case pixels <= 2560*1440:
+		return "1440p"
+	default:
+		return "2160p"
+	}
+}
+
+func getFramerateBucket(framerate int32) string {
+	if framerate <= 30 {
+		return "30"
+	}
+	return "60"
+}
+
+func getStreamShape(urls int) string {
+	if urls > maxShapeStreams {
+		return fmt.Sprintf("stream:%d+", maxShapeStreams)
+	}
+	return fmt.Sprintf("stream:%d", urls)
+}
+
+func getOutputs(file *livekit.EncodedFileOutput, stream *livekit.StreamOutput, segments *livekit.SegmentedFileOutput) []string {
+	var outputs []string
+	if file != nil {
+		outputs = append(outputs, "file")
+	}
+	if stream != nil {
+		outputs = append(outputs, getStreamShape(len(stream.Urls)))
+	}
+	if segments != nil {
+		outputs = append(outputs, "segments")
+	}
+	return outputs
+}
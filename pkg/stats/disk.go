@@ -0,0 +1,223 @@
+package stats
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/protocol/livekit"
+	"github.com/abdulhaseeb08/protocol/logger"
+)
+
+const (
+	defaultVideoBitrate = 4500
+	defaultAudioBitrate = 128
+	trackBitrate        = 2500 // track requests are not transcoded, assume a high quality publisher
+)
+
+type diskHold struct {
+	bytes     float64
+	duration  time.Duration
+	startedAt time.Time
+}
+
+// GetDiskFree returns the number of bytes available on the filesystem containing path
+func GetDiskFree(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+func (m *Monitor) startDiskStats(conf *config.Config) {
+	m.localDirectory = conf.LocalOutputDirectory
+	m.diskConfig = conf.Disk
+	m.sessionLimits = conf.SessionLimits
+	m.diskHolds = make(map[string]*diskHold)
+
+	promDiskFree := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "disk_free_bytes",
+		ConstLabels: m.constLabels(),
+	}, func() float64 {
+		free, _ := GetDiskFree(m.localDirectory)
+		return float64(free)
+	})
+
+	promDiskReserved := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "disk_reserved_bytes",
+		ConstLabels: m.constLabels(),
+	}, m.getDiskReserved)
+
+	prometheus.MustRegister(promDiskFree, promDiskReserved)
+}
+
+// CanAcceptDisk checks that the estimated output of the request fits on the local disk
+func (m *Monitor) CanAcceptDisk(req *livekit.StartEgressRequest) bool {
+	required, _ := m.estimateDiskUsage(req)
+	if required == 0 {
+		return true
+	}
+
+	free, err := GetDiskFree(m.localDirectory)
+	if err != nil {
+		logger.Warnw("could not read disk usage", err, "path", m.localDirectory)
+		return true
+	}
+
+	available := float64(free) - m.getDiskReserved() - float64(m.diskConfig.MinFreeMB)*1e6
+	accept := available > required
+
+	logger.Debugw("disk request", "accepted", accept, "availableBytes", available, "requiredBytes", required)
+	return accept
+}
+
+func (m *Monitor) holdDisk(req *livekit.StartEgressRequest) {
+	bytes, duration := m.estimateDiskUsage(req)
+	if bytes == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	m.diskHolds[req.EgressId] = &diskHold{
+		bytes:     bytes,
+		duration:  duration,
+		startedAt: time.Now(),
+	}
+	m.mu.Unlock()
+}
+
+func (m *Monitor) releaseDisk(req *livekit.StartEgressRequest) {
+	m.mu.Lock()
+	delete(m.diskHolds, req.EgressId)
+	m.mu.Unlock()
+}
+
+// getDiskReserved returns the space still expected to be written by active egresses
+func (m *Monitor) getDiskReserved() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reserved float64
+	for _, hold := range m.diskHolds {
+		// written bytes are already reflected in the free space
+		remaining := 1 - float64(time.Since(hold.startedAt))/float64(hold.duration)
+		if remaining > 0 {
+			reserved += hold.bytes * remaining
+		}
+	}
+
+	return reserved
+}
+
+// estimateDiskUsage returns the expected output size in bytes for file and segment requests
+func (m *Monitor) estimateDiskUsage(req *livekit.StartEgressRequest) (float64, time.Duration) {
+	var kbps int32
+	var duration time.Duration
+
+	switch r := req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite:
+		switch r.RoomComposite.Output.(type) {
+		case *livekit.RoomCompositeEgressRequest_File:
+			duration = m.sessionLimits.FileOutputMaxDuration
+		case *livekit.RoomCompositeEgressRequest_Segments:
+			duration = m.sessionLimits.SegmentOutputMaxDuration
+		default:
+			return 0, 0
+		}
+		kbps = getBitrate(r.RoomComposite.Options, r.RoomComposite.AudioOnly, r.RoomComposite.VideoOnly)
+
+	case *livekit.StartEgressRequest_Web:
+		switch r.Web.Output.(type) {
+		case *livekit.WebEgressRequest_File:
+			duration = m.sessionLimits.FileOutputMaxDuration
+		case *livekit.WebEgressRequest_Segments:
+			duration = m.sessionLimits.SegmentOutputMaxDuration
+		default:
+			return 0, 0
+		}
+		kbps = getBitrate(r.Web.Options, r.Web.AudioOnly, r.Web.VideoOnly)
+
+	case *livekit.StartEgressRequest_TrackComposite:
+		switch r.TrackComposite.Output.(type) {
+		case *livekit.TrackCompositeEgressRequest_File,
+			*livekit.TrackCompositeEgressRequest_FileAndStream:
+			duration = m.sessionLimits.FileOutputMaxDuration
+		case *livekit.TrackCompositeEgressRequest_Segments:
+			duration = m.sessionLimits.SegmentOutputMaxDuration
+		default:
+			return 0, 0
+		}
+		kbps = getBitrate(r.TrackComposite.Options, r.TrackComposite.VideoTrackId == "", r.TrackComposite.AudioTrackId == "")
+
+	case *livekit.StartEgressRequest_Track:
+		if r.Track.GetFile() == nil {
+			return 0, 0
+		}
+		duration = m.sessionLimits.FileOutputMaxDuration
+		kbps = trackBitrate
+	}
+
+	if duration <= 0 {
+		duration = m.diskConfig.EstimatedDuration
+	}
+
+	return float64(kbps) * 1000 / 8 * duration.Seconds(), duration
+}
+
+func getBitrate(options interface{}, audioOnly, videoOnly bool) int32 {
+	videoBitrate := int32(defaultVideoBitrate)
+	audioBitrate := int32(defaultAudioBitrate)
+
+	var preset livekit.EncodingOptionsPreset
+	var advanced *livekit.EncodingOptions
+	switch opts := options.(type) {
+	case *livekit.RoomCompositeEgressRequest_Preset:
+		preset = opts.Preset
+	case *livekit.RoomCompositeEgressRequest_Advanced:
+		advanced = opts.Advanced
+	case *livekit.WebEgressRequest_Preset:
+		preset = opts.Preset
+	case *livekit.WebEgressRequest_Advanced:
+		advanced = opts.Advanced
+	case *livekit.TrackCompositeEgressRequest_Preset:
+		preset = opts.Preset
+	case *livekit.TrackCompositeEgressRequest_Advanced:
+		advanced = opts.Advanced
+	default:
+		preset = livekit.EncodingOptionsPreset_H264_1080P_30
+	}
+
+	if advanced != nil {
+		if advanced.VideoBitrate != 0 {
+			videoBitrate = advanced.VideoBitrate
+		}
+		if advanced.AudioBitrate != 0 {
+			audioBitrate = advanced.AudioBitrate
+		}
+	} else {
+		switch preset {
+		case livekit.EncodingOptionsPreset_H264_720P_30,
+			livekit.EncodingOptionsPreset_PORTRAIT_H264_720P_30:
+			videoBitrate = 3000
+		case livekit.EncodingOptionsPreset_H264_1080P_60,
+			livekit.EncodingOptionsPreset_PORTRAIT_H264_1080P_60:
+			videoBitrate = 6000
+		}
+	}
+
+	switch {
+	case audioOnly:
+		return audioBitrate
+	case videoOnly:
+		return videoBitrate
+	default:
+		return videoBitrate + audioBitrate
+	}
+}
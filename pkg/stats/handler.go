@@ -0,0 +1,115 @@
+package stats
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/errors"
+)
+
+// USER_HZ, which is 100 on all supported platforms
+const clockTicks = 100
+
+// HandlerMetrics are reported by each handler process to the service
+type HandlerMetrics struct {
+	CPUSeconds  float64 `json:"cpu_seconds"`
+	MemoryBytes int64   `json:"memory_bytes"`
+	Goroutines  int     `json:"goroutines"`
+}
+
+// GetHandlerMetrics reads the resource usage of the current process and its children, such as chrome,
+// along with any processes started outside of the handler, such as a warm chrome and xvfb
+func GetHandlerMetrics(adopted ...int) *HandlerMetrics {
+	m := &HandlerMetrics{
+		Goroutines: runtime.NumGoroutine(),
+	}
+
+	seen := make(map[int]bool)
+	for _, pid := range withDescendants(append([]int{os.Getpid()}, adopted...)) {
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+
+		cpuSeconds, rss, err := readProcessStat(pid)
+		if err != nil {
+			continue
+		}
+		m.CPUSeconds += cpuSeconds
+		m.MemoryBytes += rss
+	}
+
+	return m
+}
+
+// readProcessStat returns the cpu time and resident set size of a process
+func readProcessStat(pid int) (float64, int64, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// fields after the command name start with state (3). utime is 14, stime 15 and rss 24
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 22 {
+		return 0, 0, errors.New("invalid stat")
+	}
+
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+
+	return float64(utime+stime) / clockTicks, rss * int64(os.Getpagesize()), nil
+}
+
+// RecordHandlerMetrics updates cpu costs and memory usage from the metrics reported by a handler
+func (m *Monitor) RecordHandlerMetrics(egressID string, metrics *HandlerMetrics) {
+	m.recordHandlerCPU(egressID, metrics.CPUSeconds)
+	m.recordHandlerMemory(egressID, metrics.MemoryBytes)
+}
+
+// RegisterHandlerStats exports metrics collected from running handlers
+func (m *Monitor) RegisterHandlerStats(collect func() ([]*HandlerMetrics, int)) {
+	sum := func(f func(*HandlerMetrics) float64) func() float64 {
+		return func() float64 {
+			metrics, _ := collect()
+			var total float64
+			for _, hm := range metrics {
+				total += f(hm)
+			}
+			return total
+		}
+	}
+
+	promHandlerCPU := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "handler_cpu_seconds",
+		ConstLabels: m.constLabels(),
+	}, sum(func(hm *HandlerMetrics) float64 { return hm.CPUSeconds }))
+
+	promHandlerMemory := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "handler_memory_bytes",
+		ConstLabels: m.constLabels(),
+	}, sum(func(hm *HandlerMetrics) float64 { return float64(hm.MemoryBytes) }))
+
+	promHandlersUnhealthy := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "handlers_unhealthy",
+		ConstLabels: m.constLabels(),
+	}, func() float64 {
+		_, unhealthy := collect()
+		return float64(unhealthy)
+	})
+
+	prometheus.MustRegister(promHandlerCPU, promHandlerMemory, promHandlersUnhealthy)
+}
@@ -0,0 +1,379 @@
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/protocol/logger"
+)
+
+const (
+	cgroupRoot      = "/sys/fs/cgroup"
+	cgroupCPUPeriod = 100000
+)
+
+// ResourceUsage is measured for each egress, for chargeback
+type ResourceUsage struct {
+	CPUSeconds      float64 `json:"cpu_seconds"`
+	PeakMemoryBytes int64   `json:"peak_memory_bytes"`
+	BytesWritten    int64   `json:"bytes_written"`
+}
+
+// ResourceLimiter constrains the current process and its children, and measures their usage.
+// A cgroup is created for each egress when cgroup v2 is available, otherwise rlimits and nice are used.
+type ResourceLimiter struct {
+	limit  config.ResourceLimit
+	cgroup string // empty when using rlimits
+	parent string // cgroup of the process before the egress started
+
+	mu      sync.Mutex
+	adopted []int
+
+	// restored on close when using rlimits, since pooled handlers run many egresses
+	origRlimit *syscall.Rlimit
+	origNice   *int
+
+	startSelf     syscall.Rusage
+	startChildren syscall.Rusage
+}
+
+func NewResourceLimiter(conf config.ResourceLimitsConfig, egressID string, limit config.ResourceLimit) *ResourceLimiter {
+	l := &ResourceLimiter{
+		limit: limit,
+	}
+	_ = syscall.Getrusage(syscall.RUSAGE_SELF, &l.startSelf)
+	_ = syscall.Getrusage(syscall.RUSAGE_CHILDREN, &l.startChildren)
+
+	if err := l.createCgroup(conf.CgroupPath, egressID); err != nil {
+		logger.Debugw("cgroups unavailable, using rlimits", "error", err)
+		l.applyRlimits()
+	}
+
+	return l
+}
+
+func (l *ResourceLimiter) createCgroup(cgroupPath, egressID string) error {
+	if _, err := os.Stat(path.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return err
+	}
+
+	parent, err := currentCgroup()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(cgroupPath, 0755); err != nil {
+		return err
+	}
+	if err = writeCgroupFile(cgroupPath, "cgroup.subtree_control", "+cpu +memory +io"); err != nil {
+		return err
+	}
+
+	dir := path.Join(cgroupPath, egressID)
+	if err = os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	if l.limit.CPU > 0 {
+		quota := int64(l.limit.CPU * cgroupCPUPeriod)
+		if err = writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)); err != nil {
+			_ = os.Remove(dir)
+			return err
+		}
+	}
+	if l.limit.MemoryMB > 0 {
+		if err = writeCgroupFile(dir, "memory.max", fmt.Sprint(l.limit.MemoryMB<<20)); err != nil {
+			_ = os.Remove(dir)
+			return err
+		}
+	}
+
+	// 0 moves the writing process, along with all of its threads
+	if err = writeCgroupFile(dir, "cgroup.procs", "0"); err != nil {
+		_ = os.Remove(dir)
+		return err
+	}
+
+	l.cgroup = dir
+	l.parent = parent
+	return nil
+}
+
+func (l *ResourceLimiter) applyRlimits() {
+	if l.limit.MemoryMB > 0 {
+		// only the soft limit is lowered, so that pooled handlers can raise it again
+		var rlimit syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_DATA, &rlimit); err == nil {
+			orig := rlimit
+			l.origRlimit = &orig
+			rlimit.Cur = l.limit.MemoryMB << 20
+			if rlimit.Cur > rlimit.Max {
+				rlimit.Cur = rlimit.Max
+			}
+			if err = syscall.Setrlimit(syscall.RLIMIT_DATA, &rlimit); err != nil {
+				logger.Warnw("failed to set memory limit", err)
+			}
+		}
+	}
+
+	if l.limit.Nice > 0 {
+		// the kernel returns 20 - nice
+		if prio, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0); err == nil {
+			nice := 20 - prio
+			l.origNice = &nice
+		}
+		if err := setNice(l.limit.Nice); err != nil {
+			logger.Warnw("failed to set nice", err)
+		}
+	}
+}
+
+// restoreRlimits resets the memory limit and nice of the process to their values before the egress
+func (l *ResourceLimiter) restoreRlimits() {
+	if l.origRlimit != nil {
+		if err := syscall.Setrlimit(syscall.RLIMIT_DATA, l.origRlimit); err != nil {
+			logger.Warnw("failed to restore memory limit", err)
+		}
+	}
+
+	if l.origNice != nil {
+		// lowering nice requires CAP_SYS_NICE or a sufficient RLIMIT_NICE
+		if err := setNice(*l.origNice); err != nil {
+			logger.Warnw("failed to restore nice", err)
+		}
+	}
+}
+
+// setNice sets the nice of every thread, since niceness is per thread on linux and new threads inherit it from their creator
+func setNice(nice int) error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, task := range tasks {
+		if tid, err := strconv.Atoi(task.Name()); err == nil {
+			if err = syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+// Adopt moves processes started outside of the handler, and their children, under its limits
+func (l *ResourceLimiter) Adopt(pids []int) {
+	l.mu.Lock()
+	l.adopted = append(l.adopted, pids...)
+	l.mu.Unlock()
+
+	for _, pid := range withDescendants(pids) {
+		var err error
+		if l.cgroup != "" {
+			err = writeCgroupFile(l.cgroup, "cgroup.procs", strconv.Itoa(pid))
+		} else if l.limit.Nice > 0 {
+			err = syscall.Setpriority(syscall.PRIO_PROCESS, pid, l.limit.Nice)
+		}
+		if err != nil {
+			logger.Warnw("failed to adopt process", err, "pid", pid)
+		}
+	}
+}
+
+// Metrics reads the current usage of the handler, including adopted processes
+func (l *ResourceLimiter) Metrics() *HandlerMetrics {
+	l.mu.Lock()
+	adopted := append([]int{}, l.adopted...)
+	l.mu.Unlock()
+
+	m := GetHandlerMetrics(adopted...)
+
+	// the cgroup also counts the cpu time of processes which have exited
+	if l.cgroup != "" {
+		if cpuStat, err := readCgroupKeys(path.Join(l.cgroup, "cpu.stat")); err == nil {
+			m.CPUSeconds = time.Duration(cpuStat["usage_usec"] * int64(time.Microsecond)).Seconds()
+		}
+	}
+
+	return m
+}
+
+// Usage returns the resources used since the limiter was created
+func (l *ResourceLimiter) Usage() *ResourceUsage {
+	if l.cgroup != "" {
+		if usage, err := readCgroupUsage(l.cgroup); err == nil {
+			return usage
+		}
+	}
+
+	var self, children syscall.Rusage
+	_ = syscall.Getrusage(syscall.RUSAGE_SELF, &self)
+	_ = syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children)
+
+	cpu := func(r *syscall.Rusage) int64 {
+		return r.Utime.Nano() + r.Stime.Nano()
+	}
+
+	usage := &ResourceUsage{
+		CPUSeconds: time.Duration(
+			cpu(&self) - cpu(&l.startSelf) + cpu(&children) - cpu(&l.startChildren),
+		).Seconds(),
+		// block output operations are counted in 512 byte units
+		BytesWritten: (self.Oublock - l.startSelf.Oublock + children.Oublock - l.startChildren.Oublock) * 512,
+	}
+
+	// maxrss is in kilobytes, and cannot be reset between pooled requests
+	maxRSS := self.Maxrss
+	if children.Maxrss > maxRSS {
+		maxRSS = children.Maxrss
+	}
+	usage.PeakMemoryBytes = maxRSS * 1024
+
+	return usage
+}
+
+// Close moves the process and any adopted processes back to the original cgroup, and removes the egress cgroup.
+// When using rlimits, the original memory limit and nice are restored instead
+func (l *ResourceLimiter) Close() {
+	if l.cgroup == "" {
+		l.restoreRlimits()
+		return
+	}
+
+	if err := writeCgroupFile(l.parent, "cgroup.procs", "0"); err != nil {
+		logger.Warnw("failed to leave egress cgroup", err)
+		return
+	}
+	l.mu.Lock()
+	adopted := l.adopted
+	l.mu.Unlock()
+	for _, pid := range withDescendants(adopted) {
+		_ = writeCgroupFile(l.parent, "cgroup.procs", strconv.Itoa(pid))
+	}
+
+	// children may take a moment to exit
+	for i := 0; i < 10; i++ {
+		if err := os.Remove(l.cgroup); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	logger.Warnw("failed to remove egress cgroup", nil, "cgroup", l.cgroup)
+}
+
+func readCgroupUsage(dir string) (*ResourceUsage, error) {
+	usage := &ResourceUsage{}
+
+	cpuStat, err := readCgroupKeys(path.Join(dir, "cpu.stat"))
+	if err != nil {
+		return nil, err
+	}
+	usage.CPUSeconds = time.Duration(cpuStat["usage_usec"] * int64(time.Microsecond)).Seconds()
+
+	// memory.peak requires linux 5.19
+	if b, err := os.ReadFile(path.Join(dir, "memory.peak")); err == nil {
+		usage.PeakMemoryBytes, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	} else if b, err = os.ReadFile(path.Join(dir, "memory.current")); err == nil {
+		usage.PeakMemoryBytes, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+
+	// one line per device, ex. "8:0 rbytes=1 wbytes=2 rios=3 wios=4 dbytes=0 dios=0"
+	if f, err := os.Open(path.Join(dir, "io.stat")); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			for _, field := range strings.Fields(scanner.Text()) {
+				if v := strings.TrimPrefix(field, "wbytes="); v != field {
+					n, _ := strconv.ParseInt(v, 10, 64)
+					usage.BytesWritten += n
+				}
+			}
+		}
+		_ = f.Close()
+	}
+
+	return usage, nil
+}
+
+// readCgroupKeys parses flat keyed files such as cpu.stat
+func readCgroupKeys(filename string) (map[string]int64, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]int64)
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			values[fields[0]], _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return values, nil
+}
+
+// currentCgroup returns the cgroup v2 directory of the current process
+func currentCgroup() (string, error) {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if p := strings.TrimPrefix(line, "0::"); p != line {
+			return path.Join(cgroupRoot, p), nil
+		}
+	}
+	return "", fmt.Errorf("not in a cgroup v2 hierarchy")
+}
+
+func writeCgroupFile(dir, filename, value string) error {
+	return os.WriteFile(path.Join(dir, filename), []byte(value), 0644)
+}
+
+// withDescendants returns the given pids and all of their children
+func withDescendants(pids []int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return pids
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(path.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// the command name may contain spaces, so fields are read after its closing paren
+		stat := string(b)
+		fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		if ppid, err := strconv.Atoi(fields[1]); err == nil {
+			children[ppid] = append(children[ppid], pid)
+		}
+	}
+
+	var all []int
+	queue := append([]int{}, pids...)
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		all = append(all, pid)
+		queue = append(queue, children[pid]...)
+	}
+	return all
+}
@@ -0,0 +1,183 @@
+package stats
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/abdulhaseeb08/egress-ehancement/pkg/config"
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+type memoryHold struct {
+	requestType string
+	bytes       float64 // configured cost
+	rss         float64 // last measured by the handler
+}
+
+// GetMemoryAvailable returns the memory which can be used without swapping, limited by the cgroup of the service
+func GetMemoryAvailable() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var available uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// ex. "MemAvailable:   12345678 kB"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			available = kb * 1024
+			break
+		}
+	}
+
+	// containers are usually limited well below the host's memory
+	if cgroup, err := currentCgroup(); err == nil {
+		limit, err1 := readCgroupUint(path.Join(cgroup, "memory.max"))
+		current, err2 := readCgroupUint(path.Join(cgroup, "memory.current"))
+		if err1 == nil && err2 == nil && limit > current && limit-current < available {
+			available = limit - current
+		}
+	}
+
+	return available, nil
+}
+
+// readCgroupUint reads a single value file, which is not set when it contains "max"
+func readCgroupUint(filename string) (uint64, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+func (m *Monitor) startMemoryStats(conf *config.Config) {
+	m.memoryCostConfig = conf.MemoryCost
+	m.memoryHolds = make(map[string]*memoryHold)
+
+	promMemoryAvailable := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "memory_available_bytes",
+		ConstLabels: m.constLabels(),
+	}, func() float64 {
+		available, _ := GetMemoryAvailable()
+		return float64(available)
+	})
+
+	promMemoryReserved := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "memory_reserved_bytes",
+		ConstLabels: m.constLabels(),
+	}, m.getMemoryReserved)
+
+	m.promEgressMemory = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "egress_memory_bytes",
+		ConstLabels: m.constLabels(),
+	}, []string{"egress_id", "type"})
+
+	prometheus.MustRegister(promMemoryAvailable, promMemoryReserved, m.promEgressMemory)
+}
+
+// canAcceptMemory checks that the expected memory of the request is available
+func (m *Monitor) canAcceptMemory(req *livekit.StartEgressRequest) (bool, float64, float64) {
+	required := m.getMemoryCost(req)
+
+	available, err := GetMemoryAvailable()
+	if err != nil {
+		return true, 0, required
+	}
+
+	free := float64(available) - m.getMemoryReserved() - float64(m.memoryCostConfig.MinFreeMB)*1e6
+	return free > required, free, required
+}
+
+func (m *Monitor) holdMemory(req *livekit.StartEgressRequest) {
+	m.mu.Lock()
+	m.memoryHolds[req.EgressId] = &memoryHold{
+		requestType: getRequestType(req),
+		bytes:       m.getMemoryCost(req),
+	}
+	m.mu.Unlock()
+}
+
+func (m *Monitor) releaseMemory(req *livekit.StartEgressRequest) {
+	m.mu.Lock()
+	delete(m.memoryHolds, req.EgressId)
+	m.mu.Unlock()
+
+	m.promEgressMemory.Delete(prometheus.Labels{"egress_id": req.EgressId, "type": getRequestType(req)})
+}
+
+func (m *Monitor) recordHandlerMemory(egressID string, rss int64) {
+	m.mu.Lock()
+	hold := m.memoryHolds[egressID]
+	if hold != nil {
+		hold.rss = float64(rss)
+	}
+	m.mu.Unlock()
+
+	if hold != nil {
+		m.promEgressMemory.With(prometheus.Labels{"egress_id": egressID, "type": hold.requestType}).Set(float64(rss))
+	}
+}
+
+// getMemoryReserved returns the memory active egresses are expected to use, which they are not using yet
+func (m *Monitor) getMemoryReserved() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var reserved float64
+	for _, hold := range m.memoryHolds {
+		// used memory is already reflected in the available memory
+		if hold.bytes > hold.rss {
+			reserved += hold.bytes - hold.rss
+		}
+	}
+
+	return reserved
+}
+
+func (m *Monitor) getMemoryCost(req *livekit.StartEgressRequest) float64 {
+	var gb float64
+	switch req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite:
+		gb = m.memoryCostConfig.RoomCompositeMemoryCost
+	case *livekit.StartEgressRequest_Web:
+		gb = m.memoryCostConfig.WebMemoryCost
+	case *livekit.StartEgressRequest_TrackComposite:
+		gb = m.memoryCostConfig.TrackCompositeMemoryCost
+	case *livekit.StartEgressRequest_Track:
+		gb = m.memoryCostConfig.TrackMemoryCost
+	}
+	return gb * 1e9
+}
+
+func getRequestType(req *livekit.StartEgressRequest) string {
+	switch req.Request.(type) {
+	case *livekit.StartEgressRequest_RoomComposite:
+		return "room_composite"
+	case *livekit.StartEgressRequest_Web:
+		return "web"
+	case *livekit.StartEgressRequest_TrackComposite:
+		return "track_composite"
+	case *livekit.StartEgressRequest_Track:
+		return "track"
+	}
+	return "unknown"
+}
@@ -1,8 +1,11 @@
 package stats
 
 import (
+	"regexp"
 	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/frostbyte73/go-throttle"
@@ -16,17 +19,42 @@ import (
 	"github.com/abdulhaseeb08/protocol/utils"
 )
 
+var labelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 type Monitor struct {
+	nodeID        string
+	labels        map[string]string
 	cpuCostConfig config.CPUCostConfig
 
-	promCPULoad  prometheus.Gauge
-	requestGauge *prometheus.GaugeVec
+	memoryCostConfig config.MemoryCostConfig
+
+	promCPULoad      prometheus.Gauge
+	promCPUCost      *prometheus.GaugeVec
+	promEgressMemory *prometheus.GaugeVec
+	requestGauge     *prometheus.GaugeVec
+	reclaimedFiles   *prometheus.CounterVec
+	reclaimedBytes   *prometheus.CounterVec
+	promQueueDropped *prometheus.CounterVec
+
+	promUploads          *prometheus.CounterVec
+	promUploadBytes      *prometheus.CounterVec
+	promUploadThroughput *prometheus.HistogramVec
+	promStalls           *prometheus.CounterVec
 
 	cpuStats *utils.CPUStats
 
 	pendingCPUs     atomic.Float64
 	numCPUs         float64
 	warningThrottle func(func())
+
+	mu             sync.Mutex
+	localDirectory string
+	diskConfig     config.DiskConfig
+	sessionLimits  config.SessionLimits
+	diskHolds      map[string]*diskHold
+	cpuCosts       map[string]*CPUCostEstimate
+	cpuSamples     map[string]*cpuSample
+	memoryHolds    map[string]*memoryHold
 }
 
 func NewMonitor() *Monitor {
@@ -40,29 +68,54 @@ func (m *Monitor) Start(conf *config.Config, isAvailable func() float64) error {
 	if err := m.checkCPUConfig(conf.CPUCost); err != nil {
 		return err
 	}
+	if err := checkLabels(conf.Labels); err != nil {
+		return err
+	}
+	m.cpuCostConfig = conf.CPUCost
+	m.nodeID = conf.NodeID
+	m.labels = conf.Labels
 
 	promNodeAvailable := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Namespace:   "livekit",
 		Subsystem:   "egress",
 		Name:        "available",
-		ConstLabels: prometheus.Labels{"node_id": conf.NodeID},
+		ConstLabels: m.constLabels(),
 	}, isAvailable)
 
 	m.promCPULoad = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace:   "livekit",
 		Subsystem:   "node",
 		Name:        "cpu_load",
-		ConstLabels: prometheus.Labels{"node_id": conf.NodeID, "node_type": "EGRESS"},
+		ConstLabels: m.constLabels("node_type", "EGRESS"),
 	})
 
 	m.requestGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace:   "livekit",
 		Subsystem:   "egress",
 		Name:        "requests",
-		ConstLabels: prometheus.Labels{"node_id": conf.NodeID},
+		ConstLabels: m.constLabels(),
 	}, []string{"type"})
 
-	prometheus.MustRegister(promNodeAvailable, m.promCPULoad, m.requestGauge)
+	m.reclaimedFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "orphaned_files_total",
+		ConstLabels: m.constLabels(),
+	}, []string{"action"})
+
+	m.reclaimedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "orphaned_bytes_total",
+		ConstLabels: m.constLabels(),
+	}, []string{"action"})
+
+	prometheus.MustRegister(promNodeAvailable, m.promCPULoad, m.requestGauge, m.reclaimedFiles, m.reclaimedBytes)
+	m.startDiskStats(conf)
+	m.initCPUCosts()
+	m.startMemoryStats(conf)
+	m.initUploadStats()
+	m.initStallStats()
 
 	cpuStats, err := utils.NewCPUStats(func(idle float64) {
 		m.promCPULoad.Set(1 - idle/m.numCPUs)
@@ -100,7 +153,7 @@ func (m *Monitor) checkCPUConfig(costConfig config.CPUCostConfig) error {
 	}
 	if costConfig.TrackCpuCost < 0.5 {
 		logger.Warnw("track requirement too low", nil,
-			"config value", costConfig.RoomCompositeCpuCost,
+			"config value", costConfig.TrackCpuCost,
 			"minimum value", 0.5,
 			"recommended value", 1,
 		)
@@ -139,47 +192,69 @@ func (m *Monitor) checkCPUConfig(costConfig config.CPUCostConfig) error {
 	return nil
 }
 
+// constLabels returns the node id and node labels, which are added to every metric
+func (m *Monitor) constLabels(keyValues ...string) prometheus.Labels {
+	labels := prometheus.Labels{"node_id": m.nodeID}
+	for k, v := range m.labels {
+		labels[k] = v
+	}
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		labels[keyValues[i]] = keyValues[i+1]
+	}
+	return labels
+}
+
+// checkLabels ensures node labels are valid prometheus label names, and do not conflict with metric labels
+func checkLabels(labels map[string]string) error {
+	for k := range labels {
+		if !labelNameRegex.MatchString(k) || strings.HasPrefix(k, "__") {
+			return errors.ErrInvalidLabel(k)
+		}
+		switch k {
+		case "node_id", "node_type", "type", "action", "shape", "egress_id", "reason":
+			return errors.ErrInvalidLabel(k)
+		}
+	}
+	return nil
+}
+
 func (m *Monitor) GetCPULoad() float64 {
 	return (m.numCPUs - m.cpuStats.GetCPUIdle()) / m.numCPUs * 100
 }
 
 func (m *Monitor) CanAcceptRequest(req *livekit.StartEgressRequest) bool {
-	accept := false
 	available := m.cpuStats.GetCPUIdle() - m.pendingCPUs.Load()
+	cost, ok := m.getCPUCost(req)
+	accept := ok && available > cost
 
-	switch req.Request.(type) {
-	case *livekit.StartEgressRequest_RoomComposite:
-		accept = available > m.cpuCostConfig.RoomCompositeCpuCost
-	case *livekit.StartEgressRequest_Web:
-		accept = available > m.cpuCostConfig.WebCpuCost
-	case *livekit.StartEgressRequest_TrackComposite:
-		accept = available > m.cpuCostConfig.TrackCompositeCpuCost
-	case *livekit.StartEgressRequest_Track:
-		accept = available > m.cpuCostConfig.TrackCpuCost
+	logger.Debugw("cpu request", "accepted", accept, "availableCPUs", available, "cost", cost, "numCPUs", runtime.NumCPU())
+	if !accept {
+		return false
 	}
 
-	logger.Debugw("cpu request", "accepted", accept, "availableCPUs", available, "numCPUs", runtime.NumCPU())
+	accept, free, required := m.canAcceptMemory(req)
+	logger.Debugw("memory request", "accepted", accept, "availableBytes", free, "requiredBytes", required)
 	return accept
 }
 
 func (m *Monitor) AcceptRequest(req *livekit.StartEgressRequest) {
-	var cpuHold float64
-	switch req.Request.(type) {
-	case *livekit.StartEgressRequest_RoomComposite:
-		cpuHold = m.cpuCostConfig.RoomCompositeCpuCost
-	case *livekit.StartEgressRequest_Web:
-		cpuHold = m.cpuCostConfig.WebCpuCost
-	case *livekit.StartEgressRequest_TrackComposite:
-		cpuHold = m.cpuCostConfig.TrackCompositeCpuCost
-	case *livekit.StartEgressRequest_Track:
-		cpuHold = m.cpuCostConfig.TrackCpuCost
-	}
-
+	cpuHold, _ := m.getCPUCost(req)
 	m.pendingCPUs.Add(cpuHold)
 	time.AfterFunc(time.Second, func() { m.pendingCPUs.Sub(cpuHold) })
+
+	m.holdDisk(req)
+	m.holdMemory(req)
+}
+
+// ReleaseRequest drops the disk and memory held for an accepted request which could not be started
+func (m *Monitor) ReleaseRequest(req *livekit.StartEgressRequest) {
+	m.releaseDisk(req)
+	m.releaseMemory(req)
 }
 
 func (m *Monitor) EgressStarted(req *livekit.StartEgressRequest) {
+	m.startCPUSampling(req)
+
 	switch req.Request.(type) {
 	case *livekit.StartEgressRequest_RoomComposite:
 		m.requestGauge.With(prometheus.Labels{"type": "room_composite"}).Add(1)
@@ -193,6 +268,9 @@ func (m *Monitor) EgressStarted(req *livekit.StartEgressRequest) {
 }
 
 func (m *Monitor) EgressEnded(req *livekit.StartEgressRequest) {
+	m.ReleaseRequest(req)
+	m.stopCPUSampling(req)
+
 	switch req.Request.(type) {
 	case *livekit.StartEgressRequest_RoomComposite:
 		m.requestGauge.With(prometheus.Labels{"type": "room_composite"}).Sub(1)
@@ -204,3 +282,35 @@ func (m *Monitor) EgressEnded(req *livekit.StartEgressRequest) {
 		m.requestGauge.With(prometheus.Labels{"type": "track"}).Sub(1)
 	}
 }
+
+// FileReclaimed records an orphaned file which was either "uploaded" or "deleted"
+func (m *Monitor) FileReclaimed(action string, size int64) {
+	m.reclaimedFiles.With(prometheus.Labels{"action": action}).Add(1)
+	m.reclaimedBytes.With(prometheus.Labels{"action": action}).Add(float64(size))
+}
+
+// RegisterQueueStats exports the depth of the request queue, and the number of queued requests which were dropped
+func (m *Monitor) RegisterQueueStats(depth func() int) {
+	promQueueDepth := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "queue_depth",
+		ConstLabels: m.constLabels(),
+	}, func() float64 {
+		return float64(depth())
+	})
+
+	m.promQueueDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "queue_dropped_total",
+		ConstLabels: m.constLabels(),
+	}, []string{"reason"})
+
+	prometheus.MustRegister(promQueueDepth, m.promQueueDropped)
+}
+
+// QueueDropped records a queued request which was either "expired" or "evicted"
+func (m *Monitor) QueueDropped(reason string) {
+	m.promQueueDropped.With(prometheus.Labels{"reason": reason}).Add(1)
+}
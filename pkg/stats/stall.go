@@ -0,0 +1,27 @@
+package stats
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StallStats are reported by a handler each time the watchdog finds a stalled pipeline
+type StallStats struct {
+	Probe  string `json:"probe"`
+	Action string `json:"action"`
+}
+
+func (m *Monitor) initStallStats() {
+	m.promStalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "stalls_total",
+		ConstLabels: m.constLabels(),
+	}, []string{"probe", "action"})
+
+	prometheus.MustRegister(m.promStalls)
+}
+
+// RecordStall counts a stall reported by a handler
+func (m *Monitor) RecordStall(s *StallStats) {
+	m.promStalls.With(prometheus.Labels{"probe": s.Probe, "action": s.Action}).Add(1)
+}
@@ -0,0 +1,61 @@
+package stats
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UploadStats are reported by a handler for each uploaded file
+type UploadStats struct {
+	Provider string  `json:"provider"`
+	Bytes    int64   `json:"bytes"`
+	Seconds  float64 `json:"seconds"`
+	Failed   bool    `json:"failed,omitempty"`
+}
+
+// BytesPerSecond returns the upload throughput
+func (u *UploadStats) BytesPerSecond() float64 {
+	if u.Seconds <= 0 {
+		return 0
+	}
+	return float64(u.Bytes) / u.Seconds
+}
+
+func (m *Monitor) initUploadStats() {
+	m.promUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "uploads_total",
+		ConstLabels: m.constLabels(),
+	}, []string{"provider", "result"})
+
+	m.promUploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "upload_bytes_total",
+		ConstLabels: m.constLabels(),
+	}, []string{"provider"})
+
+	m.promUploadThroughput = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "upload_bytes_per_second",
+		ConstLabels: m.constLabels(),
+		Buckets:     prometheus.ExponentialBuckets(1<<16, 4, 10), // 64KB/s to 16GB/s
+	}, []string{"provider"})
+
+	prometheus.MustRegister(m.promUploads, m.promUploadBytes, m.promUploadThroughput)
+}
+
+// RecordUpload updates upload metrics from the stats reported by a handler
+func (m *Monitor) RecordUpload(u *UploadStats) {
+	if u.Failed {
+		m.promUploads.With(prometheus.Labels{"provider": u.Provider, "result": "failed"}).Add(1)
+		return
+	}
+
+	m.promUploads.With(prometheus.Labels{"provider": u.Provider, "result": "succeeded"}).Add(1)
+	m.promUploadBytes.With(prometheus.Labels{"provider": u.Provider}).Add(float64(u.Bytes))
+	if bps := u.BytesPerSecond(); bps > 0 {
+		m.promUploadThroughput.With(prometheus.Labels{"provider": u.Provider}).Observe(bps)
+	}
+}
@@ -0,0 +1,134 @@
+package stats
+
+import (
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/abdulhaseeb08/protocol/livekit"
+)
+
+// EgressInfo has no field for resource usage, so it is sent as an unknown field which is preserved by proto
+// marshalling. The usage message is encoded as
+//
+//	message ResourceUsage {
+//	  double cpu_seconds = 1;
+//	  int64 peak_memory_bytes = 2;
+//	  int64 bytes_written = 3;
+//	}
+//	ResourceUsage usage = 100; // in EgressInfo
+const egressInfoUsageField protowire.Number = 100
+
+const (
+	usageCPUSecondsField      protowire.Number = 1
+	usagePeakMemoryBytesField protowire.Number = 2
+	usageBytesWrittenField    protowire.Number = 3
+)
+
+// SetEgressInfoUsage adds usage to an EgressInfo, replacing any usage already set
+func SetEgressInfoUsage(info *livekit.EgressInfo, usage *ResourceUsage) {
+	var b []byte
+	b = protowire.AppendTag(b, usageCPUSecondsField, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, math.Float64bits(usage.CPUSeconds))
+	b = protowire.AppendTag(b, usagePeakMemoryBytesField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(usage.PeakMemoryBytes))
+	b = protowire.AppendTag(b, usageBytesWrittenField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(usage.BytesWritten))
+
+	unknown := removeField(info.ProtoReflect().GetUnknown(), egressInfoUsageField)
+	unknown = protowire.AppendTag(unknown, egressInfoUsageField, protowire.BytesType)
+	unknown = protowire.AppendBytes(unknown, b)
+	info.ProtoReflect().SetUnknown(unknown)
+}
+
+// GetEgressInfoUsage returns the usage set on an EgressInfo, or nil
+func GetEgressInfoUsage(info *livekit.EgressInfo) *ResourceUsage {
+	var usage *ResourceUsage
+	b := info.ProtoReflect().GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil
+		}
+		b = b[n:]
+
+		if num == egressInfoUsageField && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil
+			}
+			usage = decodeUsage(v)
+			b = b[n:]
+			continue
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return nil
+		}
+		b = b[n:]
+	}
+	return usage
+}
+
+func decodeUsage(b []byte) *ResourceUsage {
+	usage := &ResourceUsage{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil
+		}
+		b = b[n:]
+
+		switch {
+		case num == usageCPUSecondsField && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return nil
+			}
+			usage.CPUSeconds = math.Float64frombits(v)
+			b = b[n:]
+		case num == usagePeakMemoryBytesField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil
+			}
+			usage.PeakMemoryBytes = int64(v)
+			b = b[n:]
+		case num == usageBytesWrittenField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil
+			}
+			usage.BytesWritten = int64(v)
+			b = b[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil
+			}
+			b = b[n:]
+		}
+	}
+	return usage
+}
+
+// removeField returns raw fields without any occurrences of num
+func removeField(b []byte, num protowire.Number) []byte {
+	var out []byte
+	for len(b) > 0 {
+		n, typ, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			return out
+		}
+		valLen := protowire.ConsumeFieldValue(n, typ, b[tagLen:])
+		if valLen < 0 {
+			return out
+		}
+		if n != num {
+			out = append(out, b[:tagLen+valLen]...)
+		}
+		b = b[tagLen+valLen:]
+	}
+	return out
+}